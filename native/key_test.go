@@ -0,0 +1,66 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package native
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSampleKeyBytesRoundTrip(t *testing.T) {
+	want := SampleKey{
+		FingerprintHash:  0x0102030405060708,
+		FirstLabelLetter: 'a',
+		Modulus:          7,
+		LastLabelLetter:  'z',
+		Timestamp:        1234567890,
+	}
+
+	buf := want.Bytes()
+	if len(buf) != sampleKeyLen {
+		t.Fatalf("got %d bytes, want %d", len(buf), sampleKeyLen)
+	}
+
+	got := SampleKeyFromBytes(buf)
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestSampleKeyBytesOrderingMatchesCompare(t *testing.T) {
+	// Each pair differs in exactly one field, in priority order, so a
+	// mismatch pinpoints which field's placement in Bytes broke the
+	// ordering compare (and therefore LevelDB's default comparator) is
+	// supposed to produce.
+	lower := SampleKey{FingerprintHash: 1, FirstLabelLetter: 'a', Modulus: 1, LastLabelLetter: 'a', Timestamp: 100}
+	cases := []SampleKey{
+		{FingerprintHash: 2, FirstLabelLetter: 'a', Modulus: 1, LastLabelLetter: 'a', Timestamp: 100},
+		{FingerprintHash: 1, FirstLabelLetter: 'b', Modulus: 1, LastLabelLetter: 'a', Timestamp: 100},
+		{FingerprintHash: 1, FirstLabelLetter: 'a', Modulus: 2, LastLabelLetter: 'a', Timestamp: 100},
+		{FingerprintHash: 1, FirstLabelLetter: 'a', Modulus: 1, LastLabelLetter: 'b', Timestamp: 100},
+		{FingerprintHash: 1, FirstLabelLetter: 'a', Modulus: 1, LastLabelLetter: 'a', Timestamp: 200},
+	}
+
+	lowerBuf := lower.Bytes()
+	for _, higher := range cases {
+		higherBuf := higher.Bytes()
+
+		if got := bytes.Compare(lowerBuf, higherBuf); got >= 0 {
+			t.Errorf("bytes.Compare(%+v, %+v) = %d, want < 0", lower, higher, got)
+		}
+		if got := compare(string(lowerBuf), len(lowerBuf), string(higherBuf), len(higherBuf)); got >= 0 {
+			t.Errorf("compare(%+v, %+v) = %d, want < 0", lower, higher, got)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// decodeBatchSize is the number of samples accumulated before they are
+// handed off to the Ingester as one batch. Keeping it small and bounded
+// means a target response is never fully buffered in memory, which matters
+// once target responses are large and produced incrementally rather than
+// all at once.
+const decodeBatchSize = 512
+
+// SampleDecoder turns a scrape response body into samples, handed to
+// ingester in batches as they are parsed rather than all at once. contentType
+// is the response's Content-Type header and may be used to select among
+// supported wire formats.
+type SampleDecoder interface {
+	Decode(r io.Reader, contentType string, baseLabels clientmodel.LabelSet, ingester Ingester) error
+}
+
+// defaultSampleDecoder is used by target.scrape when no decoder was
+// explicitly configured. It dispatches on the response's negotiated
+// Content-Type: a recognized protobuf or text exposition format format goes
+// to protoSampleDecoder, anything else (including no Content-Type at all)
+// falls back to the legacy JSON decoder, matching how scrape targets
+// historically responded before content negotiation was introduced.
+var defaultSampleDecoder SampleDecoder = negotiatingSampleDecoder{}
+
+// negotiatingSampleDecoder picks a concrete SampleDecoder based on the
+// scrape response's Content-Type header.
+type negotiatingSampleDecoder struct{}
+
+func (negotiatingSampleDecoder) Decode(r io.Reader, contentType string, baseLabels clientmodel.LabelSet, ingester Ingester) error {
+	format := expfmt.ResponseFormat(http.Header{"Content-Type": []string{contentType}})
+	if format == expfmt.FmtUnknown {
+		return jsonSampleDecoder{}.Decode(r, contentType, baseLabels, ingester)
+	}
+	return protoSampleDecoder{format: format}.Decode(r, contentType, baseLabels, ingester)
+}
+
+// protoSampleDecoder decodes a negotiated protobuf or text MetricFamily
+// exposition format via expfmt, one MetricFamily at a time via its
+// streaming decoder, so a scrape response is never buffered whole. It
+// flattens each family the same way AppendMetricFamilies does for the push
+// ingestion path: summaries and histograms decompose into their
+// quantile/bucket plus _sum/_count child series.
+type protoSampleDecoder struct {
+	format expfmt.Format
+}
+
+func (d protoSampleDecoder) Decode(r io.Reader, _ string, baseLabels clientmodel.LabelSet, ingester Ingester) error {
+	dec := expfmt.NewDecoder(r, d.format)
+
+	batch := make(clientmodel.Samples, 0, decodeBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := ingester.Ingest(batch); err != nil {
+			return err
+		}
+		batch = make(clientmodel.Samples, 0, decodeBatchSize)
+		return nil
+	}
+
+	for {
+		var mf dto.MetricFamily
+		if err := dec.Decode(&mf); err != nil {
+			if err == io.EOF {
+				return flush()
+			}
+			return err
+		}
+		for _, s := range flattenFamily(&mf, baseLabels) {
+			batch = append(batch, s)
+			if len(batch) >= decodeBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// flattenFamily turns a single decoded MetricFamily into samples, merging
+// baseLabels onto every one. Counters, gauges, and untyped values become
+// one sample each; summaries and histograms become one sample per
+// quantile/bucket plus a _sum and a _count sample.
+func flattenFamily(mf *dto.MetricFamily, baseLabels clientmodel.LabelSet) clientmodel.Samples {
+	name := mf.GetName()
+	var samples clientmodel.Samples
+
+	baseMetric := func(labels []*dto.LabelPair) clientmodel.Metric {
+		m := clientmodel.Metric{clientmodel.MetricNameLabel: clientmodel.LabelValue(name)}
+		for ln, lv := range baseLabels {
+			m[ln] = lv
+		}
+		for _, lp := range labels {
+			m[clientmodel.LabelName(lp.GetName())] = clientmodel.LabelValue(lp.GetValue())
+		}
+		return m
+	}
+
+	childSample := func(suffix string, labels []*dto.LabelPair, ts clientmodel.Timestamp, value float64) *clientmodel.Sample {
+		met := baseMetric(labels)
+		met[clientmodel.MetricNameLabel] = clientmodel.LabelValue(name + suffix)
+		return &clientmodel.Sample{Metric: met, Timestamp: ts, Value: clientmodel.SampleValue(value)}
+	}
+
+	for _, m := range mf.GetMetric() {
+		ts := clientmodel.Timestamp(m.GetTimestampMs())
+
+		switch mf.GetType() {
+		case dto.MetricType_SUMMARY:
+			s := m.GetSummary()
+			for _, q := range s.GetQuantile() {
+				met := baseMetric(m.GetLabel())
+				met[clientmodel.LabelName("quantile")] = clientmodel.LabelValue(fmt.Sprint(q.GetQuantile()))
+				samples = append(samples, &clientmodel.Sample{Metric: met, Timestamp: ts, Value: clientmodel.SampleValue(q.GetValue())})
+			}
+			samples = append(samples, childSample("_sum", m.GetLabel(), ts, s.GetSampleSum()))
+			samples = append(samples, childSample("_count", m.GetLabel(), ts, float64(s.GetSampleCount())))
+		case dto.MetricType_HISTOGRAM:
+			h := m.GetHistogram()
+			for _, b := range h.GetBucket() {
+				met := baseMetric(m.GetLabel())
+				met[clientmodel.MetricNameLabel] = clientmodel.LabelValue(name + "_bucket")
+				met[clientmodel.LabelName("le")] = clientmodel.LabelValue(fmt.Sprint(b.GetUpperBound()))
+				samples = append(samples, &clientmodel.Sample{Metric: met, Timestamp: ts, Value: clientmodel.SampleValue(b.GetCumulativeCount())})
+			}
+			samples = append(samples, childSample("_sum", m.GetLabel(), ts, h.GetSampleSum()))
+			samples = append(samples, childSample("_count", m.GetLabel(), ts, float64(h.GetSampleCount())))
+		case dto.MetricType_COUNTER:
+			samples = append(samples, &clientmodel.Sample{Metric: baseMetric(m.GetLabel()), Timestamp: ts, Value: clientmodel.SampleValue(m.GetCounter().GetValue())})
+		case dto.MetricType_GAUGE:
+			samples = append(samples, &clientmodel.Sample{Metric: baseMetric(m.GetLabel()), Timestamp: ts, Value: clientmodel.SampleValue(m.GetGauge().GetValue())})
+		default:
+			samples = append(samples, &clientmodel.Sample{Metric: baseMetric(m.GetLabel()), Timestamp: ts, Value: clientmodel.SampleValue(m.GetUntyped().GetValue())})
+		}
+	}
+	return samples
+}
+
+// legacySample mirrors a single entry of the Prometheus 0.0.2 JSON
+// exposition format: a metric's base labels, and its values at one or more
+// points in time.
+type legacySample struct {
+	BaseLabels clientmodel.LabelSet `json:"baseLabels"`
+	Docstring  string               `json:"docstring"`
+	Metric     struct {
+		BucketLabel string               `json:"bucket_label"`
+		Buckets     map[string]float64   `json:"buckets"`
+		Value       float64              `json:"value"`
+		Labels      clientmodel.LabelSet `json:"labels"`
+	} `json:"metric"`
+	Value string `json:"value"`
+}
+
+// jsonSampleDecoder decodes the legacy JSON exposition format
+// (`[]legacySample`) using a token-driven json.Decoder rather than
+// unmarshaling the whole body into a slice, so that arbitrarily large
+// responses are parsed and ingested incrementally instead of buffered
+// whole.
+type jsonSampleDecoder struct{}
+
+func (jsonSampleDecoder) Decode(r io.Reader, _ string, baseLabels clientmodel.LabelSet, ingester Ingester) error {
+	dec := json.NewDecoder(r)
+
+	// Consume the opening '[' of the top-level array. An empty body (no
+	// samples at all) is not an error.
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil
+	}
+
+	batch := make(clientmodel.Samples, 0, decodeBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := ingester.Ingest(batch); err != nil {
+			return err
+		}
+		batch = make(clientmodel.Samples, 0, decodeBatchSize)
+		return nil
+	}
+
+	for dec.More() {
+		var entry legacySample
+		if err := dec.Decode(&entry); err != nil {
+			return err
+		}
+		metric := clientmodel.Metric{}
+		for ln, lv := range baseLabels {
+			metric[ln] = lv
+		}
+		for ln, lv := range entry.BaseLabels {
+			metric[ln] = lv
+		}
+		batch = append(batch, &clientmodel.Sample{
+			Metric: metric,
+			Value:  clientmodel.SampleValue(entry.Metric.Value),
+		})
+		if len(batch) >= decodeBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
@@ -0,0 +1,71 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"strings"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+const textExposition = `# HELP http_requests_total Total requests.
+# TYPE http_requests_total counter
+http_requests_total{method="get"} 13
+`
+
+func TestNegotiatingSampleDecoderPicksProtoTextForTextContentType(t *testing.T) {
+	ingester := &collectResultIngester{}
+	err := defaultSampleDecoder.Decode(
+		strings.NewReader(textExposition),
+		"text/plain; version=0.0.4",
+		clientmodel.LabelSet{clientmodel.JobLabel: "testjob"},
+		ingester,
+	)
+	if err != nil {
+		t.Fatalf("Decode returned an error: %s", err)
+	}
+	if len(ingester.result) != 1 {
+		t.Fatalf("got %d samples, want 1", len(ingester.result))
+	}
+	s := ingester.result[0]
+	if s.Metric[clientmodel.MetricNameLabel] != "http_requests_total" {
+		t.Errorf("metric name = %q, want %q", s.Metric[clientmodel.MetricNameLabel], "http_requests_total")
+	}
+	if s.Metric["method"] != "get" {
+		t.Errorf("method label = %q, want %q", s.Metric["method"], "get")
+	}
+	if s.Metric[clientmodel.JobLabel] != "testjob" {
+		t.Errorf("base label not merged in: job = %q, want %q", s.Metric[clientmodel.JobLabel], "testjob")
+	}
+	if s.Value != 13 {
+		t.Errorf("value = %v, want 13", s.Value)
+	}
+}
+
+func TestNegotiatingSampleDecoderFallsBackToJSONForUnknownContentType(t *testing.T) {
+	ingester := &collectResultIngester{}
+	err := defaultSampleDecoder.Decode(
+		strings.NewReader(`[{"baseLabels":{"__name__":"foo"},"metric":{"value":1},"value":"1"}]`),
+		"",
+		clientmodel.LabelSet{},
+		ingester,
+	)
+	if err != nil {
+		t.Fatalf("Decode returned an error: %s", err)
+	}
+	if len(ingester.result) != 1 {
+		t.Fatalf("got %d samples, want 1", len(ingester.result))
+	}
+}
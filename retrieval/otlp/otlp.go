@@ -0,0 +1,256 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package otlp provides an HTTP receiver that accepts OTLP
+// ExportMetricsServiceRequest payloads and feeds the resulting samples into
+// the same Ingester the scrape-based retrieval path uses.
+package otlp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/retrieval"
+)
+
+// Path is the HTTP path the Receiver is mounted at, mirroring the OTLP
+// collector's default export path for metrics.
+const Path = "/api/v1/otlp/v1/metrics"
+
+// createdSuffix names the synthesized series that preserves counter-reset
+// semantics for an OTLP-origin cumulative series across ingestion: OTLP
+// carries a start time per data point rather than the single "created"
+// timestamp the Prometheus text/protobuf exposition formats use for the
+// same purpose, so the receiver synthesizes an equivalent series here.
+const createdSuffix = "_created"
+
+// Receiver decodes OTLP metric export requests and feeds the resulting
+// samples to an Ingester, acting as a peer to retrieval.Target for
+// push-based ingestion.
+type Receiver struct {
+	Ingester retrieval.Ingester
+
+	// mtx guards lastStartTime, the per-series StartTimeUnixNano last seen
+	// across requests. A "_created" sample is only synthesized when a
+	// series' start time changes, which is how OTLP signals a counter
+	// reset; without this, every export of an unchanged cumulative series
+	// would re-synthesize a "_created" sample for it.
+	mtx           sync.Mutex
+	lastStartTime map[clientmodel.Fingerprint]uint64
+}
+
+// NewHandler returns an http.Handler serving Path, backed by a Receiver
+// that ingests into ingester.
+func NewHandler(ingester retrieval.Ingester) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(Path, &Receiver{
+		Ingester:      ingester,
+		lastStartTime: make(map[clientmodel.Fingerprint]uint64),
+	})
+	return mux
+}
+
+// ServeHTTP implements http.Handler. It expects a protobuf-encoded
+// ExportMetricsServiceRequest body, per the OTLP metrics service.
+func (recv *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var expReq colmetricpb.ExportMetricsServiceRequest
+	if err := proto.Unmarshal(body, &expReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	samples := recv.translate(&expReq)
+	if len(samples) > 0 {
+		if err := recv.Ingester.Ingest(samples); err != nil {
+			glog.Error("Error ingesting OTLP samples: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// translate flattens an OTLP export request into Prometheus samples:
+// resource and scope attributes become base labels merged onto each
+// metric's own data-point attributes, and every numeric data point becomes
+// one sample, decomposing histograms and summaries into their
+// _bucket/_count/_sum and quantile child series the same way the
+// text/protobuf exposition formats do. Cumulative data points (monotonic
+// sums, histograms, summaries) additionally produce a synthesized
+// "<name>_created" sample the first time a series' StartTimeUnixNano is
+// observed or whenever it changes from the previously seen one, giving
+// rate()-style queries the same counter-reset signal a text-format scrape
+// with a created-timestamp would have produced.
+func (recv *Receiver) translate(req *colmetricpb.ExportMetricsServiceRequest) clientmodel.Samples {
+	var samples clientmodel.Samples
+
+	for _, rm := range req.GetResourceMetrics() {
+		resourceLabels := attributesToLabels(rm.GetResource().GetAttributes())
+		for _, sm := range rm.GetScopeMetrics() {
+			scopeLabels := attributesToLabels(sm.GetScope().GetAttributes())
+			baseLabels := clientmodel.LabelSet{}
+			for ln, lv := range resourceLabels {
+				baseLabels[ln] = lv
+			}
+			for ln, lv := range scopeLabels {
+				baseLabels[ln] = lv
+			}
+			for _, m := range sm.GetMetrics() {
+				samples = append(samples, recv.metricToSamples(m, baseLabels)...)
+			}
+		}
+	}
+	return samples
+}
+
+func (recv *Receiver) metricToSamples(m *metricpb.Metric, baseLabels clientmodel.LabelSet) clientmodel.Samples {
+	var samples clientmodel.Samples
+
+	baseMetric := func(name string, attrs []*commonpb.KeyValue) clientmodel.Metric {
+		metric := clientmodel.Metric{clientmodel.MetricNameLabel: clientmodel.LabelValue(name)}
+		for ln, lv := range baseLabels {
+			metric[ln] = lv
+		}
+		for ln, lv := range attributesToLabels(attrs) {
+			metric[ln] = lv
+		}
+		return metric
+	}
+
+	addPoint := func(attrs []*commonpb.KeyValue, tsNano, startTsNano uint64, value float64, cumulative bool) {
+		metric := baseMetric(m.GetName(), attrs)
+		ts := clientmodel.Timestamp(int64(tsNano / uint64(1e6)))
+		samples = append(samples, &clientmodel.Sample{
+			Metric:    metric,
+			Timestamp: ts,
+			Value:     clientmodel.SampleValue(value),
+		})
+		if cumulative {
+			recv.maybeAddCreated(&samples, metric, m.GetName(), startTsNano)
+		}
+	}
+
+	switch data := m.GetData().(type) {
+	case *metricpb.Metric_Gauge:
+		for _, dp := range data.Gauge.GetDataPoints() {
+			addPoint(dp.GetAttributes(), dp.GetTimeUnixNano(), 0, dp.GetAsDouble(), false)
+		}
+	case *metricpb.Metric_Sum:
+		for _, dp := range data.Sum.GetDataPoints() {
+			addPoint(
+				dp.GetAttributes(),
+				dp.GetTimeUnixNano(),
+				dp.GetStartTimeUnixNano(),
+				dp.GetAsDouble(),
+				data.Sum.GetIsMonotonic(),
+			)
+		}
+	case *metricpb.Metric_Histogram:
+		for _, dp := range data.Histogram.GetDataPoints() {
+			ts := clientmodel.Timestamp(int64(dp.GetTimeUnixNano() / uint64(1e6)))
+			counts := dp.GetBucketCounts()
+			bounds := dp.GetExplicitBounds()
+			var cumulativeCount uint64
+			for i, count := range counts {
+				cumulativeCount += count
+				bound := "+Inf"
+				if i < len(bounds) {
+					bound = fmt.Sprint(bounds[i])
+				}
+				bucketAttrs := append(append([]*commonpb.KeyValue{}, dp.GetAttributes()...), &commonpb.KeyValue{
+					Key:   "le",
+					Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: bound}},
+				})
+				metric := baseMetric(m.GetName()+"_bucket", bucketAttrs)
+				samples = append(samples, &clientmodel.Sample{Metric: metric, Timestamp: ts, Value: clientmodel.SampleValue(cumulativeCount)})
+			}
+			samples = append(samples, &clientmodel.Sample{Metric: baseMetric(m.GetName()+"_sum", dp.GetAttributes()), Timestamp: ts, Value: clientmodel.SampleValue(dp.GetSum())})
+			countMetric := baseMetric(m.GetName()+"_count", dp.GetAttributes())
+			samples = append(samples, &clientmodel.Sample{Metric: countMetric, Timestamp: ts, Value: clientmodel.SampleValue(float64(dp.GetCount()))})
+			recv.maybeAddCreated(&samples, countMetric, m.GetName(), dp.GetStartTimeUnixNano())
+		}
+	case *metricpb.Metric_Summary:
+		for _, dp := range data.Summary.GetDataPoints() {
+			ts := clientmodel.Timestamp(int64(dp.GetTimeUnixNano() / uint64(1e6)))
+			for _, q := range dp.GetQuantileValues() {
+				quantileAttrs := append(append([]*commonpb.KeyValue{}, dp.GetAttributes()...), &commonpb.KeyValue{
+					Key:   "quantile",
+					Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: fmt.Sprint(q.GetQuantile())}},
+				})
+				metric := baseMetric(m.GetName(), quantileAttrs)
+				samples = append(samples, &clientmodel.Sample{Metric: metric, Timestamp: ts, Value: clientmodel.SampleValue(q.GetValue())})
+			}
+			samples = append(samples, &clientmodel.Sample{Metric: baseMetric(m.GetName()+"_sum", dp.GetAttributes()), Timestamp: ts, Value: clientmodel.SampleValue(dp.GetSum())})
+			countMetric := baseMetric(m.GetName()+"_count", dp.GetAttributes())
+			samples = append(samples, &clientmodel.Sample{Metric: countMetric, Timestamp: ts, Value: clientmodel.SampleValue(float64(dp.GetCount()))})
+			recv.maybeAddCreated(&samples, countMetric, m.GetName(), dp.GetStartTimeUnixNano())
+		}
+	}
+	return samples
+}
+
+// maybeAddCreated appends a "<name>_created" sample for metric to samples
+// if startTsNano is set and differs from the last StartTimeUnixNano seen
+// for this exact series (metric, including its labels). Per the "created
+// timestamp" convention, the sample is timestamped one millisecond before
+// the start time, with a value of 0, rather than the start time and value
+// the series itself carries.
+func (recv *Receiver) maybeAddCreated(samples *clientmodel.Samples, metric clientmodel.Metric, name string, startTsNano uint64) {
+	if startTsNano == 0 {
+		return
+	}
+	fp := metric.FastFingerprint()
+
+	recv.mtx.Lock()
+	prev, seen := recv.lastStartTime[fp]
+	changed := !seen || prev != startTsNano
+	if changed {
+		recv.lastStartTime[fp] = startTsNano
+	}
+	recv.mtx.Unlock()
+
+	if !changed {
+		return
+	}
+
+	created := metric.Clone()
+	created[clientmodel.MetricNameLabel] = clientmodel.LabelValue(name + createdSuffix)
+	*samples = append(*samples, &clientmodel.Sample{
+		Metric:    created,
+		Timestamp: clientmodel.Timestamp(int64(startTsNano/uint64(1e6)) - 1),
+		Value:     0,
+	})
+}
+
+func attributesToLabels(attrs []*commonpb.KeyValue) clientmodel.LabelSet {
+	labels := clientmodel.LabelSet{}
+	for _, kv := range attrs {
+		labels[clientmodel.LabelName(kv.GetKey())] = clientmodel.LabelValue(kv.GetValue().GetStringValue())
+	}
+	return labels
+}
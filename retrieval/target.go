@@ -0,0 +1,207 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/utility"
+)
+
+// InstanceLabel is the label name used for the scrape target's URL.
+const InstanceLabel clientmodel.LabelName = "instance"
+
+const (
+	scrapeHealthMetricName   clientmodel.LabelValue = "up"
+	scrapeDurationMetricName clientmodel.LabelValue = "scrape_duration_seconds"
+)
+
+// TargetState describes the last known state of a scrape target.
+type TargetState int
+
+const (
+	// Unknown is the state of a target before it has been scraped for the
+	// first time.
+	Unknown TargetState = iota
+	// Alive is the state of a target that was successfully scraped.
+	Alive
+	// Unreachable is the state of a target that could not be reached or
+	// did not return a usable response.
+	Unreachable
+)
+
+// Ingester ingests samples produced by scraping or otherwise decoding a
+// target response.
+type Ingester interface {
+	Ingest(clientmodel.Samples) error
+}
+
+// nopIngester is an Ingester that discards everything it is given. It is
+// used by tests and callers that only care about a target's side effects
+// (state, health metrics) and not about the samples themselves.
+type nopIngester struct{}
+
+func (n nopIngester) Ingest(clientmodel.Samples) error {
+	return nil
+}
+
+// Target models a scrapeable endpoint.
+type Target interface {
+	// RunScraper scrapes the target at the given interval, feeding
+	// ingested samples to ingester, until StopScraper is called.
+	RunScraper(ingester Ingester, interval time.Duration)
+	// StopScraper causes RunScraper to return.
+	StopScraper()
+}
+
+// target is a Target implementation backed by a plain HTTP(S) endpoint.
+type target struct {
+	url        string
+	baseLabels clientmodel.LabelSet
+	httpClient *http.Client
+	// decoder turns a scrape response body into batches of samples. A nil
+	// decoder falls back to defaultSampleDecoder, which streams the
+	// response rather than buffering it whole.
+	decoder SampleDecoder
+
+	state      TargetState
+	lastScrape time.Time
+
+	scraperStopping chan struct{}
+	scraperStopped  chan struct{}
+}
+
+// NewTarget returns a Target for the given URL and scrape deadline. If
+// decoder is nil, the target uses defaultSampleDecoder to parse scrape
+// responses.
+func NewTarget(url string, deadline time.Duration, baseLabels clientmodel.LabelSet, decoder SampleDecoder) Target {
+	return &target{
+		url:             url,
+		baseLabels:      baseLabels,
+		httpClient:      utility.NewDeadlineClient(deadline),
+		decoder:         decoder,
+		state:           Unknown,
+		scraperStopping: make(chan struct{}),
+		scraperStopped:  make(chan struct{}),
+	}
+}
+
+// scrape fetches and ingests samples from the target's URL. It is not
+// goroutine-safe; callers serialize invocations via RunScraper.
+func (t *target) scrape(ingester Ingester) (err error) {
+	start := time.Now()
+	defer func() {
+		t.recordScrapeHealth(ingester, clientmodel.Now(), err == nil, time.Since(start))
+	}()
+
+	req, err := http.NewRequest("GET", t.url, nil)
+	if err != nil {
+		t.state = Unreachable
+		return err
+	}
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		t.state = Unreachable
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.state = Unreachable
+		return fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+
+	decoder := t.decoder
+	if decoder == nil {
+		decoder = defaultSampleDecoder
+	}
+	if err := decoder.Decode(resp.Body, resp.Header.Get("Content-Type"), t.baseLabels, ingester); err != nil {
+		t.state = Unreachable
+		return err
+	}
+	t.state = Alive
+	return nil
+}
+
+// recordScrapeHealth ingests two synthetic samples describing the outcome
+// of a scrape: whether the target was up, and how long the scrape took.
+func (t *target) recordScrapeHealth(
+	ingester Ingester,
+	timestamp clientmodel.Timestamp,
+	healthy bool,
+	scrapeDuration time.Duration,
+) {
+	healthValue := clientmodel.SampleValue(0)
+	if healthy {
+		healthValue = clientmodel.SampleValue(1)
+	}
+
+	baseLabels := clientmodel.LabelSet{InstanceLabel: clientmodel.LabelValue(t.url)}
+	for ln, lv := range t.baseLabels {
+		baseLabels[ln] = lv
+	}
+
+	healthMetric := clientmodel.Metric{}
+	durationMetric := clientmodel.Metric{}
+	for ln, lv := range baseLabels {
+		healthMetric[ln] = lv
+		durationMetric[ln] = lv
+	}
+	healthMetric[clientmodel.MetricNameLabel] = scrapeHealthMetricName
+	durationMetric[clientmodel.MetricNameLabel] = scrapeDurationMetricName
+
+	ingester.Ingest(clientmodel.Samples{
+		&clientmodel.Sample{
+			Metric:    healthMetric,
+			Timestamp: timestamp,
+			Value:     healthValue,
+		},
+		&clientmodel.Sample{
+			Metric:    durationMetric,
+			Timestamp: timestamp,
+			Value:     clientmodel.SampleValue(scrapeDuration.Seconds()),
+		},
+	})
+}
+
+// RunScraper implements Target.
+func (t *target) RunScraper(ingester Ingester, interval time.Duration) {
+	defer close(t.scraperStopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	t.scrape(ingester)
+	t.lastScrape = time.Now()
+
+	for {
+		select {
+		case <-t.scraperStopping:
+			return
+		case <-ticker.C:
+			t.scrape(ingester)
+			t.lastScrape = time.Now()
+		}
+	}
+}
+
+// StopScraper implements Target.
+func (t *target) StopScraper() {
+	close(t.scraperStopping)
+	<-t.scraperStopped
+}
@@ -0,0 +1,143 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+// bitWriter accumulates individual bits and variable-width bit groups into a
+// byte slice, most-significant-bit first. It backs doubleDeltaEncodedChunk's
+// bit-packed timestamp and value encoding.
+type bitWriter struct {
+	buf     []byte
+	cur     byte
+	curBits uint
+}
+
+func newBitWriter() *bitWriter {
+	return &bitWriter{}
+}
+
+// newBitWriterFromBytes wraps an already-encoded byte slice for appending
+// further bits to it; used when unmarshaling a chunk that might still
+// receive more samples before being closed out.
+func newBitWriterFromBytes(b []byte) *bitWriter {
+	return &bitWriter{buf: append([]byte{}, b...)}
+}
+
+func (w *bitWriter) writeBit(bit byte) {
+	w.cur = w.cur<<1 | (bit & 1)
+	w.curBits++
+	if w.curBits == 8 {
+		w.buf = append(w.buf, w.cur)
+		w.cur = 0
+		w.curBits = 0
+	}
+}
+
+// writeBits writes the low nBits bits of v, most-significant bit first.
+func (w *bitWriter) writeBits(v uint64, nBits int) {
+	for i := nBits - 1; i >= 0; i-- {
+		w.writeBit(byte(v >> uint(i) & 1))
+	}
+}
+
+// writeVarbitInt writes a signed integer using the variable-length scheme
+// described in doubleDeltaEncodedChunk's doc comment: zero in one bit,
+// increasingly wide signed ranges behind longer prefixes.
+func (w *bitWriter) writeVarbitInt(d int64) {
+	switch {
+	case d == 0:
+		w.writeBit(0)
+	case -63 <= d && d <= 63:
+		w.writeBit(1)
+		w.writeBit(0)
+		w.writeBits(uint64(d), 7)
+	case -255 <= d && d <= 255:
+		w.writeBits(0x6, 3) // '110'
+		w.writeBits(uint64(d), 9)
+	case -2047 <= d && d <= 2047:
+		w.writeBits(0xe, 4) // '1110'
+		w.writeBits(uint64(d), 12)
+	default:
+		w.writeBits(0xf, 4) // '1111'
+		w.writeBits(uint64(uint32(d)), 32)
+	}
+}
+
+// bytes returns the written bits, zero-padding the final partial byte. The
+// reader needs out-of-band knowledge of the sample count (held by the
+// chunk itself) to know when to stop decoding padding as data.
+func (w *bitWriter) bytes() []byte {
+	if w.curBits == 0 {
+		return w.buf
+	}
+	pad := w.cur << (8 - w.curBits)
+	return append(append([]byte{}, w.buf...), pad)
+}
+
+func (w *bitWriter) reader() *bitReader {
+	return &bitReader{buf: w.bytes()}
+}
+
+// bitReader reads individual bits and variable-width bit groups back out of
+// a byte slice written by bitWriter, in the same most-significant-bit-first
+// order.
+type bitReader struct {
+	buf     []byte
+	byteIdx int
+	bitIdx  uint // number of bits already consumed from buf[byteIdx], MSB-first.
+}
+
+func (r *bitReader) readBit() byte {
+	if r.byteIdx >= len(r.buf) {
+		return 0
+	}
+	bit := (r.buf[r.byteIdx] >> (7 - r.bitIdx)) & 1
+	r.bitIdx++
+	if r.bitIdx == 8 {
+		r.bitIdx = 0
+		r.byteIdx++
+	}
+	return bit
+}
+
+func (r *bitReader) readBits(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint64(r.readBit())
+	}
+	return v
+}
+
+// readVarbitInt reads back an integer written by writeVarbitInt.
+func (r *bitReader) readVarbitInt() int64 {
+	if r.readBit() == 0 {
+		return 0
+	}
+	if r.readBit() == 0 {
+		return signExtend(r.readBits(7), 7)
+	}
+	if r.readBit() == 0 {
+		return signExtend(r.readBits(9), 9)
+	}
+	if r.readBit() == 0 {
+		return signExtend(r.readBits(12), 12)
+	}
+	return int64(int32(r.readBits(32)))
+}
+
+// signExtend interprets the low nBits bits of v as a two's-complement
+// integer of that width and sign-extends it to int64.
+func signExtend(v uint64, nBits uint) int64 {
+	shift := 64 - nBits
+	return int64(v<<shift) >> shift
+}
@@ -0,0 +1,38 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import "testing"
+
+func TestWriteVarbitIntRoundTrip(t *testing.T) {
+	// Each width's upper and lower bound, plus the value just past each
+	// bound (which must fall through to the next wider case rather than
+	// sign-flip), pin down the off-by-one this case ladder is prone to.
+	values := []int64{
+		0,
+		1, -1,
+		63, -63, 64, -64,
+		255, -255, 256, -256,
+		2047, -2047, 2048, -2048,
+		-((1 << 31) - 1), -(1 << 31), (1 << 31) - 1,
+	}
+	for _, want := range values {
+		w := newBitWriter()
+		w.writeVarbitInt(want)
+		r := w.reader()
+		if got := r.readVarbitInt(); got != want {
+			t.Errorf("writeVarbitInt(%d): got %d after round trip", want, got)
+		}
+	}
+}
@@ -0,0 +1,617 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// blockDuration is the width of the fixed time window every chunk block
+// covers. It is not (yet) configurable: changing it after blocks already
+// exist on disk would require re-bucketing them, which migrateToBlocks does
+// not attempt.
+const blockDuration = 2 * time.Hour
+
+const (
+	blocksDirName    = "blocks"
+	blockChunksFile  = "chunks.db"
+	blockIndexFile   = "index.db"
+	blockIndexRecLen = 24 // fingerprint(8) + offset(8) + length(8)
+	// blockIndexDropMarker is written to a record's length field instead of
+	// a real length to durably mark a fingerprint as dropped from the
+	// block: loadIndex replays records in order, so a drop record after a
+	// fingerprint's append records is what makes dropChunks survive a
+	// restart rather than being undone by the next loadIndex replaying the
+	// stale append records alone.
+	blockIndexDropMarker = -1
+)
+
+var storageEngine = flag.String(
+	"storage.local.engine",
+	"file",
+	"On-disk layout for chunk data. One of: file (one growing file per "+
+		"fingerprint), block (chunks bucketed into fixed-duration blocks "+
+		"shared across fingerprints, with expiry by whole-block removal).",
+)
+
+// newChunkStoreForConfiguredEngine returns the ChunkStore implementation
+// selected by -storage.local.engine, ready to use.
+func newChunkStoreForConfiguredEngine(basePath string) (ChunkStore, error) {
+	switch *storageEngine {
+	case "block":
+		return newBlockChunkStore(basePath, blockDuration)
+	case "file":
+		return newLocalFileChunkStore(basePath), nil
+	default:
+		return nil, fmt.Errorf("unknown storage engine %q", *storageEngine)
+	}
+}
+
+// blockIndexEntry locates one fingerprint's chunk record within a block's
+// shared chunks.db.
+type blockIndexEntry struct {
+	offset, length int64
+}
+
+// chunkBlock is chunks.db plus its in-memory index for a single
+// blockDuration-wide time window, shared across every fingerprint that had
+// a chunk persisted while the block was current.
+// chunkBlock's index and size fields are accessed by two different
+// concurrent paths -- blockChunkWriter.Close appending new chunks, and any
+// of blockChunkStore's read/drop methods looking a fingerprint up -- and
+// must only ever be touched while holding mtx. There is no block-level
+// reader/writer split because both paths also mutate (appendIndexRecord and
+// appendDropRecord both write to index as well as read it).
+type chunkBlock struct {
+	start, end clientmodel.Timestamp
+	dir        string
+
+	mtx     sync.Mutex
+	size    int64 // Current length of chunks.db; next write lands at this offset.
+	index   map[clientmodel.Fingerprint][]blockIndexEntry
+	minTime clientmodel.Timestamp
+	maxTime clientmodel.Timestamp
+}
+
+func blockDirName(basePath string, start clientmodel.Timestamp) string {
+	return path.Join(basePath, blocksDirName, strconv.FormatInt(int64(start), 10))
+}
+
+// openOrCreateBlock loads the block starting at start if its directory
+// already exists, or creates an empty one otherwise.
+func openOrCreateBlock(basePath string, start clientmodel.Timestamp) (*chunkBlock, error) {
+	dir := blockDirName(basePath, start)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	b := &chunkBlock{
+		start: start,
+		end:   start + clientmodel.Timestamp(blockDuration/time.Millisecond),
+		dir:   dir,
+		index: map[clientmodel.Fingerprint][]blockIndexEntry{},
+	}
+	if fi, err := os.Stat(path.Join(dir, blockChunksFile)); err == nil {
+		b.size = fi.Size()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := b.loadIndex(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// loadIndex replays blockIndexFile into the in-memory index. A trailing
+// partial record (the tail end of a write that never completed) is
+// tolerated and simply ignored, mirroring how the rest of this package
+// treats a torn write at the end of an append-only file. A record whose
+// length is blockIndexDropMarker is not a chunk record at all: it is
+// appendDropRecord's tombstone, and clears whatever entries fp has
+// accumulated so far rather than being added to them.
+func (b *chunkBlock) loadIndex() error {
+	data, err := ioutil.ReadFile(path.Join(b.dir, blockIndexFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for off := 0; off+blockIndexRecLen <= len(data); off += blockIndexRecLen {
+		rec := data[off : off+blockIndexRecLen]
+		fp := clientmodel.Fingerprint(binary.LittleEndian.Uint64(rec[0:]))
+		length := int64(binary.LittleEndian.Uint64(rec[16:]))
+		if length == blockIndexDropMarker {
+			delete(b.index, fp)
+			continue
+		}
+		entry := blockIndexEntry{
+			offset: int64(binary.LittleEndian.Uint64(rec[8:])),
+			length: length,
+		}
+		b.index[fp] = append(b.index[fp], entry)
+	}
+	return nil
+}
+
+// appendIndexRecord durably records that fp has a chunk record at
+// [offset, offset+length) in chunks.db, both in memory and on disk. Caller
+// must hold b.mtx.
+func (b *chunkBlock) appendIndexRecord(fp clientmodel.Fingerprint, offset, length int64) error {
+	f, err := os.OpenFile(path.Join(b.dir, blockIndexFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rec := make([]byte, blockIndexRecLen)
+	binary.LittleEndian.PutUint64(rec[0:], uint64(fp))
+	binary.LittleEndian.PutUint64(rec[8:], uint64(offset))
+	binary.LittleEndian.PutUint64(rec[16:], uint64(length))
+	if _, err := f.Write(rec); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	b.index[fp] = append(b.index[fp], blockIndexEntry{offset: offset, length: length})
+	return nil
+}
+
+// appendDropRecord durably records that fp's chunks in this block are gone,
+// both on disk (a blockIndexDropMarker record loadIndex recognizes, so a
+// restart doesn't resurrect fp via the append records that precede it) and
+// in memory.
+func (b *chunkBlock) appendDropRecord(fp clientmodel.Fingerprint) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	f, err := os.OpenFile(path.Join(b.dir, blockIndexFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rec := make([]byte, blockIndexRecLen)
+	binary.LittleEndian.PutUint64(rec[0:], uint64(fp))
+	binary.LittleEndian.PutUint64(rec[16:], uint64(blockIndexDropMarker))
+	if _, err := f.Write(rec); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	delete(b.index, fp)
+	return nil
+}
+
+// hasFingerprint reports whether fp has any (undropped) chunk records in b.
+func (b *chunkBlock) hasFingerprint(fp clientmodel.Fingerprint) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	_, ok := b.index[fp]
+	return ok
+}
+
+// entriesFor returns a copy of fp's chunk index entries in b, safe to read
+// without holding b.mtx.
+func (b *chunkBlock) entriesFor(fp clientmodel.Fingerprint) []blockIndexEntry {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	entries := b.index[fp]
+	if len(entries) == 0 {
+		return nil
+	}
+	out := make([]blockIndexEntry, len(entries))
+	copy(out, entries)
+	return out
+}
+
+// observe widens the block's recorded time range to include [first, last],
+// the header timestamps of a chunk just written into it.
+func (b *chunkBlock) observe(first, last clientmodel.Timestamp) {
+	if b.minTime == 0 || first.Before(b.minTime) {
+		b.minTime = first
+	}
+	if last.After(b.maxTime) {
+		b.maxTime = last
+	}
+}
+
+// blockChunkStore is a ChunkStore that, instead of giving every fingerprint
+// its own ever-growing file, appends newly persisted chunks (regardless of
+// fingerprint) into whichever fixed-duration block covers the chunk's last
+// sample timestamp, alongside a per-block index mapping fingerprint to the
+// chunk records it contributed to that block.
+//
+// A chunk persisted late, with timestamps in the past, therefore goes into
+// the older block covering those timestamps rather than the newest one.
+//
+// Expiry becomes an os.RemoveAll of a whole block directory once every
+// sample it could contain has aged out, rather than dropChunks' per-series
+// rewrite-and-rename -- see removeExpiredBlocks.
+type blockChunkStore struct {
+	basePath string
+	duration time.Duration
+
+	mtx    sync.Mutex
+	blocks []*chunkBlock // Sorted by start time, oldest first.
+}
+
+// newBlockChunkStore returns a blockChunkStore backed by basePath/blocks,
+// with every existing block directory loaded. basePath need not exist yet.
+func newBlockChunkStore(basePath string, duration time.Duration) (*blockChunkStore, error) {
+	s := &blockChunkStore{basePath: basePath, duration: duration}
+
+	dirs, err := ioutil.ReadDir(path.Join(basePath, blocksDirName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	for _, fi := range dirs {
+		if !fi.IsDir() {
+			continue
+		}
+		startUnixMillis, err := strconv.ParseInt(fi.Name(), 10, 64)
+		if err != nil {
+			continue // Not one of our block directories; leave it alone.
+		}
+		b, err := openOrCreateBlock(basePath, clientmodel.Timestamp(startUnixMillis))
+		if err != nil {
+			return nil, err
+		}
+		s.blocks = append(s.blocks, b)
+	}
+	sort.Sort(blocksByStart(s.blocks))
+	return s, nil
+}
+
+type blocksByStart []*chunkBlock
+
+func (b blocksByStart) Len() int           { return len(b) }
+func (b blocksByStart) Less(i, j int) bool { return b[i].start < b[j].start }
+func (b blocksByStart) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// blockForWrite returns the block covering ts, creating it if this is the
+// first chunk to land in that window.
+func (s *blockChunkStore) blockForWrite(ts clientmodel.Timestamp) (*chunkBlock, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	start := clientmodel.Timestamp(int64(ts) - int64(ts)%int64(s.duration/time.Millisecond))
+	for _, b := range s.blocks {
+		if b.start == start {
+			return b, nil
+		}
+	}
+	b, err := openOrCreateBlock(s.basePath, start)
+	if err != nil {
+		return nil, err
+	}
+	s.blocks = append(s.blocks, b)
+	sort.Sort(blocksByStart(s.blocks))
+	return b, nil
+}
+
+// blocksContaining returns, oldest first, every block whose index has an
+// entry for fp. s.mtx guards the s.blocks slice itself; whether fp is
+// actually present in a given block is b.mtx's concern, via hasFingerprint.
+func (s *blockChunkStore) blocksContaining(fp clientmodel.Fingerprint) []*chunkBlock {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var out []*chunkBlock
+	for _, b := range s.blocks {
+		if b.hasFingerprint(fp) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func (s *blockChunkStore) openChunkFileForReading(fp clientmodel.Fingerprint) (chunkFileReader, error) {
+	var segments []readerSegment
+	var files []*os.File
+	for _, b := range s.blocksContaining(fp) {
+		f, err := os.Open(path.Join(b.dir, blockChunksFile))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		for _, e := range b.entriesFor(fp) {
+			segments = append(segments, readerSegment{f: f, offset: e.offset, length: e.length})
+		}
+	}
+	if len(segments) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return newMultiSegmentReader(segments, files), nil
+}
+
+func (s *blockChunkStore) openChunkFileForWriting(fp clientmodel.Fingerprint) (io.WriteCloser, error) {
+	return &blockChunkWriter{store: s, fp: fp}, nil
+}
+
+// dropChunks unlinks fp from every block it appears in, durably: each
+// block gets an on-disk tombstone record (see appendDropRecord) so the
+// drop survives a restart instead of loadIndex resurrecting fp from the
+// append records that came before it. The underlying bytes in chunks.db
+// are left in place -- they are shared with other fingerprints' records
+// and are only reclaimed wholesale, once the whole block has aged out, by
+// removeExpiredBlocks.
+func (s *blockChunkStore) dropChunks(fp clientmodel.Fingerprint) error {
+	for _, b := range s.blocksContaining(fp) {
+		if err := b.appendDropRecord(fp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *blockChunkStore) sanitizeSeries(fp clientmodel.Fingerprint) (int64, error) {
+	var total int64
+	for _, b := range s.blocksContaining(fp) {
+		for _, e := range b.entriesFor(fp) {
+			total += e.length
+		}
+	}
+	return total, nil
+}
+
+// removeExpiredBlocks deletes every block whose whole time window ends at or
+// before beforeTime, returning how many were removed. The window end is
+// used rather than the block's observed sample times because those are
+// only tracked for chunks written since start-up. Unlike
+// dropChunks' per-series rewrite, this is an O(1) os.RemoveAll per expired
+// block rather than an O(series) scan.
+func (s *blockChunkStore) removeExpiredBlocks(beforeTime clientmodel.Timestamp) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	kept := s.blocks[:0]
+	removed := 0
+	for _, b := range s.blocks {
+		if !b.end.After(beforeTime) {
+			if err := os.RemoveAll(b.dir); err != nil {
+				return removed, err
+			}
+			removed++
+			continue
+		}
+		kept = append(kept, b)
+	}
+	s.blocks = kept
+	return removed, nil
+}
+
+// readerSegment is one contiguous byte range within an already-open block
+// chunks.db file.
+type readerSegment struct {
+	f              *os.File
+	offset, length int64
+}
+
+// multiSegmentReader presents a fingerprint's chunk records, which may be
+// scattered across several blocks' chunks.db files, as a single contiguous
+// io.ReadSeeker -- exactly the shape walkChunkFile (and everything built on
+// it: persistChunk, loadChunks, loadChunkDescs, dropChunks, sanitizeSeries)
+// already expects from a per-fingerprint series file.
+type multiSegmentReader struct {
+	segments []readerSegment
+	files    []*os.File // The distinct files backing segments, closed together by Close.
+	pos      int64      // Logical position across the concatenation of segments.
+	total    int64
+}
+
+func newMultiSegmentReader(segments []readerSegment, files []*os.File) *multiSegmentReader {
+	var total int64
+	for _, s := range segments {
+		total += s.length
+	}
+	return &multiSegmentReader{segments: segments, files: files, total: total}
+}
+
+// Close closes every block file backing this reader. It is safe to call
+// even though some of those files may also back other fingerprints'
+// multiSegmentReaders, since closing a *os.File only affects this handle.
+func (r *multiSegmentReader) Close() error {
+	var firstErr error
+	for _, f := range r.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (r *multiSegmentReader) Read(p []byte) (int, error) {
+	if r.pos >= r.total {
+		return 0, io.EOF
+	}
+	var base int64
+	for _, seg := range r.segments {
+		if r.pos < base+seg.length {
+			n := seg.length - (r.pos - base)
+			if int64(len(p)) < n {
+				n = int64(len(p))
+			}
+			read, err := seg.f.ReadAt(p[:n], seg.offset+(r.pos-base))
+			r.pos += int64(read)
+			return read, err
+		}
+		base += seg.length
+	}
+	return 0, io.EOF
+}
+
+func (r *multiSegmentReader) Seek(offset int64, whence int) (int64, error) {
+	var newPos int64
+	switch whence {
+	case os.SEEK_SET:
+		newPos = offset
+	case os.SEEK_CUR:
+		newPos = r.pos + offset
+	case os.SEEK_END:
+		newPos = r.total + offset
+	default:
+		return 0, fmt.Errorf("multiSegmentReader: invalid whence %d", whence)
+	}
+	if newPos < 0 {
+		return 0, fmt.Errorf("multiSegmentReader: negative position")
+	}
+	r.pos = newPos
+	return r.pos, nil
+}
+
+// blockChunkWriter buffers one Write-er's worth of appended chunk bytes (a
+// single persistChunk call's header+length-field+body) in memory, then on
+// Close appends them to the current block's chunks.db in one shot and
+// records the resulting byte range in the block's index.
+type blockChunkWriter struct {
+	store *blockChunkStore
+	fp    clientmodel.Fingerprint
+	buf   []byte
+}
+
+func (w *blockChunkWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (w *blockChunkWriter) Close() error {
+	if len(w.buf) < chunkHeaderLen {
+		return fmt.Errorf("blockChunkWriter: short chunk record (%d bytes)", len(w.buf))
+	}
+	first := clientmodel.Timestamp(binary.LittleEndian.Uint64(w.buf[chunkHeaderFirstTimeOffset:]))
+	last := clientmodel.Timestamp(binary.LittleEndian.Uint64(w.buf[chunkHeaderLastTimeOffset:]))
+
+	b, err := w.store.blockForWrite(last)
+	if err != nil {
+		return err
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	f, err := os.OpenFile(path.Join(b.dir, blockChunksFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset := b.size
+	if _, err := f.Write(w.buf); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	b.size += int64(len(w.buf))
+
+	if err := b.appendIndexRecord(w.fp, offset, int64(len(w.buf))); err != nil {
+		return err
+	}
+	b.observe(first, last)
+	return nil
+}
+
+// migrateToBlocks reads every existing per-fingerprint file under
+// basePath/xx/ via the file-based layout and rewrites its chunks into dst,
+// leaving the original files untouched so the migration can be retried (or
+// the file-based layout kept as a fallback) if it is interrupted partway
+// through. Callers are expected to do this offline, with no persistence
+// concurrently writing to basePath.
+func migrateToBlocks(basePath string, chunkLen int, dst *blockChunkStore) error {
+	src := newLocalFileChunkStore(basePath)
+	for i := 0; i < 256; i++ {
+		dirname := path.Join(basePath, fmt.Sprintf("%02x", i))
+		entries, err := ioutil.ReadDir(dirname)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, fi := range entries {
+			if fi.IsDir() {
+				continue
+			}
+			if !strings.HasSuffix(fi.Name(), seriesFileSuffix) {
+				continue
+			}
+			fpStr := fmt.Sprintf("%02x%s", i, strings.TrimSuffix(fi.Name(), seriesFileSuffix))
+			fpUint, err := strconv.ParseUint(fpStr, 16, 64)
+			if err != nil {
+				continue // Not one of our series files; leave it alone.
+			}
+			fp := clientmodel.Fingerprint(fpUint)
+			if err := migrateSeries(src, dst, fp, chunkLen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func migrateSeries(src ChunkStore, dst *blockChunkStore, fp clientmodel.Fingerprint, chunkLen int) error {
+	f, err := src.openChunkFileForReading(fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	entries, err := walkChunkFile(f, chunkLen)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		buf := make([]byte, e.length)
+		if _, err := f.Seek(e.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(f, buf); err != nil {
+			return err
+		}
+		w, err := dst.openChunkFileForWriting(fp)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -14,6 +14,7 @@
 package local
 
 import (
+	"flag"
 	"io"
 
 	clientmodel "github.com/prometheus/client_golang/model"
@@ -21,6 +22,26 @@ import (
 	"github.com/prometheus/prometheus/storage/metric"
 )
 
+var defaultChunkEncoding = flag.String(
+	"storage.local.chunk-encoding",
+	"delta",
+	"The encoding new chunks are created with. One of: delta, doubledelta, histogram.",
+)
+
+// newChunkForIngestion returns a new, empty chunk of the encoding selected
+// by the storage.local.chunk-encoding flag, for use as the head chunk of a
+// series that does not have one yet.
+func newChunkForIngestion() chunk {
+	switch *defaultChunkEncoding {
+	case "doubledelta":
+		return newDoubleDeltaEncodedChunk()
+	case "histogram":
+		return newHistogramChunk()
+	default:
+		return newDeltaEncodedChunk(d1, d0, true)
+	}
+}
+
 // chunk is the interface for all chunks. Chunks are generally not
 // goroutine-safe.
 type chunk interface {
@@ -81,6 +102,10 @@ func chunkType(c chunk) byte {
 	switch c.(type) {
 	case *deltaEncodedChunk:
 		return 0
+	case *histogramChunk:
+		return 1
+	case *doubleDeltaEncodedChunk:
+		return 2
 	default:
 		panic("unknown chunk type")
 	}
@@ -90,6 +115,10 @@ func chunkForType(chunkType byte) chunk {
 	switch chunkType {
 	case 0:
 		return newDeltaEncodedChunk(d1, d0, true)
+	case 1:
+		return newHistogramChunk()
+	case 2:
+		return newDoubleDeltaEncodedChunk()
 	default:
 		panic("unknown chunk type")
 	}
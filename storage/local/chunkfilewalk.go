@@ -0,0 +1,95 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// chunkFileEntry describes one on-disk chunk record: its starting offset
+// and its total length (header, optional compressed-length field, and
+// body). Once chunk bodies can be compressed, records no longer have a
+// fixed stride, so callers that need random access by chunk index first
+// walk the whole file to build a table of entries like this one, rather
+// than computing offsets arithmetically from chunkHeaderLen+p.chunkLen.
+type chunkFileEntry struct {
+	offset int64
+	length int64
+}
+
+// walkChunkFile reads just the headers of every complete chunk record in f,
+// starting at the current file position (callers normally seek to 0
+// first), and returns one chunkFileEntry per record. If the file ends with
+// a partial record (fewer bytes than even a header, or a truncated
+// compressed body), walking stops there and that trailing data is not
+// included in the result; callers that care (sanitizeSeries) can compare
+// against the file size to detect and trim it.
+//
+// f need only be an io.ReadSeeker: a ChunkStore need not back every
+// fingerprint's chunks with a concrete *os.File (see blockChunkStore's
+// multiSegmentReader and remoteChunkStore's in-memory reader).
+func walkChunkFile(f io.ReadSeeker, chunkLen int) ([]chunkFileEntry, error) {
+	var entries []chunkFileEntry
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, chunkHeaderLen)
+	lenBuf := make([]byte, chunkHeaderLenFieldLen)
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		_, compression := unpackTypeByte(header[chunkHeaderTypeOffset])
+
+		bodyLen := int64(chunkLen)
+		recordLen := int64(chunkHeaderLen) + bodyLen
+		if compression != chunkCompressionNone {
+			if _, err := io.ReadFull(f, lenBuf); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				}
+				return nil, err
+			}
+			bodyLen = int64(binary.LittleEndian.Uint32(lenBuf))
+			recordLen = int64(chunkHeaderLen) + int64(chunkHeaderLenFieldLen) + bodyLen
+			if _, err := f.Seek(bodyLen, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		} else {
+			if _, err := f.Seek(bodyLen, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		}
+		if offset+recordLen > end {
+			break
+		}
+
+		entries = append(entries, chunkFileEntry{offset: offset, length: recordLen})
+		offset += recordLen
+	}
+	return entries, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"io"
+	"os"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// chunkFileReader is what openChunkFileForReading returns: a seekable
+// reader that can also be closed, matching what every call site in
+// persistence.go already does with the file handle it used to get
+// straight from os.Open (read some entries, then Close when done).
+type chunkFileReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// ChunkStore abstracts the on-disk layout of per-fingerprint chunk files so
+// that persistence can transparently offload series files to a remote
+// object store once they have aged past a configurable threshold, instead
+// of only ever reading and writing basePath/xx/<fp>.db on local disk.
+//
+// Implementations need not be goroutine-safe for concurrent calls
+// referring to the same fingerprint, matching the existing contract of
+// persistChunk/loadChunks/dropChunks.
+type ChunkStore interface {
+	// openChunkFileForReading returns a handle from which chunk bytes for
+	// fp can be read, starting at offset 0 of the logical series file
+	// regardless of backing medium.
+	openChunkFileForReading(fp clientmodel.Fingerprint) (chunkFileReader, error)
+	// openChunkFileForWriting returns a handle to which new chunk bytes
+	// for fp should be appended.
+	openChunkFileForWriting(fp clientmodel.Fingerprint) (io.WriteCloser, error)
+	// dropChunks removes the series file for fp entirely (used when all
+	// chunks of a series have expired).
+	dropChunks(fp clientmodel.Fingerprint) error
+	// sanitizeSeries returns the size in bytes of the stored
+	// representation for fp (0 if there is none). It does not validate or
+	// trim it; persistence.sanitizeSeries does that for local series files.
+	sanitizeSeries(fp clientmodel.Fingerprint) (int64, error)
+}
+
+// localFileChunkStore is the original, and default, ChunkStore
+// implementation: every series' chunks live in a single growing file on
+// local disk at basePath/xx/<fp>.db.
+type localFileChunkStore struct {
+	basePath string
+}
+
+// newLocalFileChunkStore returns a ChunkStore backed by basePath, ready to
+// use.
+func newLocalFileChunkStore(basePath string) *localFileChunkStore {
+	return &localFileChunkStore{basePath: basePath}
+}
+
+func (s *localFileChunkStore) dirName(fp clientmodel.Fingerprint) string {
+	return s.basePath + "/" + fp.String()[0:2]
+}
+
+func (s *localFileChunkStore) fileName(fp clientmodel.Fingerprint) string {
+	return s.dirName(fp) + "/" + fp.String()[2:] + seriesFileSuffix
+}
+
+func (s *localFileChunkStore) openChunkFileForReading(fp clientmodel.Fingerprint) (chunkFileReader, error) {
+	return os.Open(s.fileName(fp))
+}
+
+func (s *localFileChunkStore) openChunkFileForWriting(fp clientmodel.Fingerprint) (io.WriteCloser, error) {
+	if err := os.MkdirAll(s.dirName(fp), 0700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(s.fileName(fp), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+}
+
+func (s *localFileChunkStore) dropChunks(fp clientmodel.Fingerprint) error {
+	err := os.Remove(s.fileName(fp))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localFileChunkStore) sanitizeSeries(fp clientmodel.Fingerprint) (int64, error) {
+	fi, err := os.Stat(s.fileName(fp))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
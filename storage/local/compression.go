@@ -0,0 +1,143 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"code.google.com/p/snappy-go/snappy"
+)
+
+// chunkCompression identifies the compression algorithm, if any, applied to
+// a persisted chunk's body. It is stored in the top two bits of the chunk
+// header's type byte (chunkHeaderTypeOffset), leaving the low six bits for
+// the chunk encoding itself (chunkType/chunkForType), which today only uses
+// a handful of values.
+type chunkCompression byte
+
+const (
+	chunkCompressionNone chunkCompression = iota
+	chunkCompressionSnappy
+	chunkCompressionGzip
+	// chunkCompressionFlate is raw DEFLATE (no gzip header/footer), a
+	// cheaper middle ground between chunkCompressionSnappy's speed and
+	// chunkCompressionGzip's ratio. zstd and lz4 would sit in a similar
+	// spot, and for incompressible-ish float data probably closer to
+	// chunkCompressionSnappy's end of the tradeoff, but neither is
+	// vendored anywhere in this tree the way code.google.com/p/snappy-go
+	// is, so they are left out rather than adding an unvetted dependency
+	// for this.
+	chunkCompressionFlate
+)
+
+const chunkCompressionMask byte = 0xc0
+const chunkCompressionShift = 6
+const chunkTypeMask byte = ^chunkCompressionMask
+
+var defaultChunkCompression = flag.String(
+	"storage.local.chunk-compression",
+	"none",
+	"Compression applied to newly persisted chunks. One of: none, snappy, gzip, flate.",
+)
+
+func configuredChunkCompression() chunkCompression {
+	switch *defaultChunkCompression {
+	case "snappy":
+		return chunkCompressionSnappy
+	case "gzip":
+		return chunkCompressionGzip
+	case "flate":
+		return chunkCompressionFlate
+	default:
+		return chunkCompressionNone
+	}
+}
+
+// packTypeByte combines a chunk's encoding type with the compression
+// algorithm applied to its persisted body into the single byte stored at
+// chunkHeaderTypeOffset.
+func packTypeByte(encoding byte, compression chunkCompression) byte {
+	return (encoding & chunkTypeMask) | (byte(compression) << chunkCompressionShift)
+}
+
+func unpackTypeByte(b byte) (encoding byte, compression chunkCompression) {
+	return b & chunkTypeMask, chunkCompression((b & chunkCompressionMask) >> chunkCompressionShift)
+}
+
+// compressChunkBody compresses buf with the given algorithm. compression ==
+// chunkCompressionNone returns buf unchanged.
+func compressChunkBody(buf []byte, compression chunkCompression) ([]byte, error) {
+	switch compression {
+	case chunkCompressionNone:
+		return buf, nil
+	case chunkCompressionSnappy:
+		return snappy.Encode(nil, buf)
+	case chunkCompressionGzip:
+		var out bytes.Buffer
+		w, err := gzip.NewWriterLevel(&out, gzip.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	case chunkCompressionFlate:
+		var out bytes.Buffer
+		w, err := flate.NewWriter(&out, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown chunk compression %d", compression)
+	}
+}
+
+// decompressChunkBody reverses compressChunkBody.
+func decompressChunkBody(buf []byte, compression chunkCompression) ([]byte, error) {
+	switch compression {
+	case chunkCompressionNone:
+		return buf, nil
+	case chunkCompressionSnappy:
+		return snappy.Decode(nil, buf)
+	case chunkCompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case chunkCompressionFlate:
+		r := flate.NewReader(bytes.NewReader(buf))
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("unknown chunk compression %d", compression)
+	}
+}
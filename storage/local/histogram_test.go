@@ -0,0 +1,98 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+func TestHistogramChunkMarshalUnmarshalRoundTrip(t *testing.T) {
+	c := newHistogramChunk()
+	want := []HistogramPair{
+		{
+			Timestamp: 1000,
+			Value: HistogramValue{
+				Schema:        3,
+				ZeroThreshold: 0.001,
+				ZeroCount:     2,
+				Sum:           42.5,
+				Count:         10,
+				Positive:      []HistogramBucket{{Offset: 0, Count: 3}, {Offset: 2, Count: 1}},
+				Negative:      []HistogramBucket{{Offset: 1, Count: 4}},
+			},
+		},
+		{
+			Timestamp: 2000,
+			Value: HistogramValue{
+				Schema: 3,
+				Sum:    43.5,
+				Count:  11,
+			},
+		},
+	}
+	for _, hp := range want {
+		hp := hp
+		c.addHistogram(&hp)
+	}
+
+	var buf bytes.Buffer
+	if err := c.marshal(&buf); err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+
+	got := newHistogramChunk()
+	if err := got.unmarshal(&buf); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	if !reflect.DeepEqual(got.values, want) {
+		t.Errorf("got %+v, want %+v", got.values, want)
+	}
+}
+
+func TestHistogramChunkAddOverflows(t *testing.T) {
+	c := newHistogramChunk()
+	var last *histogramChunk
+	for i := 0; i < histogramSampleCount+1; i++ {
+		hp := &HistogramPair{Timestamp: clientmodel.Timestamp(i), Value: HistogramValue{Sum: float64(i), Count: 1}}
+		newChunks := c.addHistogram(hp)
+		last = newChunks[len(newChunks)-1].(*histogramChunk)
+	}
+	if len(c.values) != histogramSampleCount {
+		t.Errorf("original chunk got %d values, want %d", len(c.values), histogramSampleCount)
+	}
+	if len(last.values) != 1 {
+		t.Errorf("overflow chunk got %d values, want 1", len(last.values))
+	}
+}
+
+func TestNewChunkForIngestionSelectsHistogramEncoding(t *testing.T) {
+	old := *defaultChunkEncoding
+	defer func() { *defaultChunkEncoding = old }()
+
+	*defaultChunkEncoding = "histogram"
+	if _, ok := newChunkForIngestion().(*histogramChunk); !ok {
+		t.Fatalf("got %T, want *histogramChunk", newChunkForIngestion())
+	}
+}
+
+func TestChunkTypeRoundTripsHistogram(t *testing.T) {
+	c := newHistogramChunk()
+	if got := chunkForType(chunkType(c)); reflect.TypeOf(got) != reflect.TypeOf(c) {
+		t.Errorf("got %T, want %T", got, c)
+	}
+}
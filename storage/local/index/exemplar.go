@@ -0,0 +1,107 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"flag"
+	"path"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+)
+
+const exemplarDir = "fingerprint_to_exemplars"
+
+var exemplarCacheSize = flag.Int("storage.fingerprintToExemplarsCacheSizeBytes", 10*1024*1024, "The size in bytes for the fingerprint to exemplars index cache.")
+
+// exemplarsPerSeries bounds the ring buffer of exemplars kept per
+// fingerprint. Once full, the oldest exemplar is evicted to make room for
+// the newest one, matching the "most recent N" semantics callers expect
+// from a cheap, bounded-memory trace-linking index rather than a full
+// exemplar store. Unlike exemplarCacheSize, which only bounds the LevelDB
+// block cache in bytes, this flag bounds the count kept per series
+// regardless of how large each exemplar's label set is.
+var exemplarsPerSeries = flag.Int("storage.maxExemplarsPerSeries", 16, "The maximum number of exemplars to keep per series in the fingerprint to exemplars index.")
+
+// Exemplar is a labelset-value-timestamp triple attached to a scalar
+// sample, linking it back to a trace. It mirrors the exemplar carried by
+// the exposition formats and OTLP.
+type Exemplar struct {
+	Labels    clientmodel.LabelSet
+	Value     clientmodel.SampleValue
+	Timestamp clientmodel.Timestamp
+}
+
+// ExemplarIndex is a KeyValueStore that maps a fingerprint to a bounded
+// ring buffer of the most recently observed exemplars for that series. It
+// sits next to FingerprintMetricIndex and FingerprintTimeRangeIndex, backed
+// by the same kind of KeyValueStore, and is looked up on demand (e.g. by
+// the query API) rather than consulted on every sample append.
+type ExemplarIndex struct {
+	KeyValueStore
+}
+
+// NewExemplarIndex returns a LevelDB-backed ExemplarIndex ready to use.
+func NewExemplarIndex(basePath string) (*ExemplarIndex, error) {
+	db, err := NewLevelDB(LevelDBOptions{
+		Path:           path.Join(basePath, exemplarDir),
+		CacheSizeBytes: *exemplarCacheSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ExemplarIndex{KeyValueStore: db}, nil
+}
+
+// Add appends an exemplar to the ring buffer stored for fp, evicting the
+// oldest entry if the buffer is already at exemplarsPerSeries. This method
+// is goroutine-safe with respect to other index methods but, like the
+// other indexes in this package, does not serialize concurrent Add calls
+// for the same fingerprint against each other; callers are expected to
+// already hold the fingerprint's lock while appending samples.
+func (i *ExemplarIndex) Add(fp clientmodel.Fingerprint, e Exemplar) error {
+	var existing codable.ExemplarRingBuffer
+	ok, err := i.Get(codable.Fingerprint(fp), &existing)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		existing = codable.ExemplarRingBuffer{}
+	}
+	existing = existing.Append(codable.Exemplar(e), *exemplarsPerSeries)
+	return i.Put(codable.Fingerprint(fp), existing)
+}
+
+// Lookup returns the exemplars currently stored for fp, oldest first.
+// Looking up a fingerprint with no stored exemplars is not an error; in
+// that case (nil, false, nil) is returned.
+func (i *ExemplarIndex) Lookup(fp clientmodel.Fingerprint) (exemplars []Exemplar, ok bool, err error) {
+	var buf codable.ExemplarRingBuffer
+	ok, err = i.Get(codable.Fingerprint(fp), &buf)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	exemplars = make([]Exemplar, len(buf))
+	for idx, e := range buf {
+		exemplars[idx] = Exemplar(e)
+	}
+	return exemplars, true, nil
+}
+
+// Delete removes all exemplars stored for fp. This is a no-op (not an
+// error) if fp has no stored exemplars.
+func (i *ExemplarIndex) Delete(fp clientmodel.Fingerprint) error {
+	return i.KeyValueStore.Delete(codable.Fingerprint(fp))
+}
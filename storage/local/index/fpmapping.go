@@ -0,0 +1,81 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"flag"
+	"path"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+)
+
+const fpMappingsDir = "fingerprint_mappings"
+
+var fpMappingsCacheSize = flag.Int("storage.fingerprintMappingsCacheSizeBytes", 5*1024*1024, "The size in bytes for the fingerprint collision mappings index cache.")
+
+// FingerprintMapping records one metric seen under a fast (collision-prone)
+// fingerprint together with the fingerprint it was assigned: the fast
+// fingerprint itself for the first such metric, a distinct, collision-free
+// one for every later metric.
+type FingerprintMapping struct {
+	Metric      clientmodel.Metric
+	Fingerprint clientmodel.Fingerprint
+}
+
+// FingerprintMappingIndex is a KeyValueStore that maps a fast fingerprint
+// (the plain FNV-1A hash of a metric's label set, as returned by
+// Metric.FastFingerprint) to every metric seen under it and the
+// fingerprint each was assigned. A fast fingerprint with more than one
+// entry here has collided.
+type FingerprintMappingIndex struct {
+	KeyValueStore
+}
+
+// NewFingerprintMappingIndex returns a LevelDB-backed
+// FingerprintMappingIndex ready to use.
+func NewFingerprintMappingIndex(basePath string) (*FingerprintMappingIndex, error) {
+	db, err := NewLevelDB(LevelDBOptions{
+		Path:           path.Join(basePath, fpMappingsDir),
+		CacheSizeBytes: *fpMappingsCacheSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &FingerprintMappingIndex{KeyValueStore: db}, nil
+}
+
+// Add records that metric was assigned mappedFP under fastFP,
+// appending to whatever mappings fastFP already has.
+func (i *FingerprintMappingIndex) Add(fastFP clientmodel.Fingerprint, metric clientmodel.Metric, mappedFP clientmodel.Fingerprint) error {
+	existing, _, err := i.Lookup(fastFP)
+	if err != nil {
+		return err
+	}
+	existing = append(existing, FingerprintMapping{Metric: metric, Fingerprint: mappedFP})
+	return i.Put(codable.Fingerprint(fastFP), codable.FingerprintMappings(existing))
+}
+
+// Lookup returns every mapping recorded for fastFP. Looking up a fast
+// fingerprint with no recorded mappings is not an error; in that case
+// (nil, false, nil) is returned.
+func (i *FingerprintMappingIndex) Lookup(fastFP clientmodel.Fingerprint) (mappings []FingerprintMapping, ok bool, err error) {
+	var buf codable.FingerprintMappings
+	ok, err = i.Get(codable.Fingerprint(fastFP), &buf)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	return []FingerprintMapping(buf), true, nil
+}
@@ -40,6 +40,22 @@ var (
 	fingerprintTimeRangeCacheSize    = flag.Int("storage.fingerprintTimeRangeCacheSizeBytes", 5*1024*1024, "The size in bytes for the metric time range index cache.")
 )
 
+// Dirs returns the basePath-relative directory names of every LevelDB
+// instance this package keeps, for callers (such as persistence's snapshot
+// support) that need to enumerate them without hard-coding or duplicating
+// the individual indexes' layout.
+func Dirs() []string {
+	return []string{
+		fingerprintToMetricDir,
+		fingerprintTimeRangeDir,
+		labelNameToLabelValuesDir,
+		labelPairToFingerprintsDir,
+		exemplarDir,
+		fpMappingsDir,
+		metricFamilyMetadataDir,
+	}
+}
+
 // FingerprintMetricMapping is an in-memory map of fingerprints to metrics.
 type FingerprintMetricMapping map[clientmodel.Fingerprint]clientmodel.Metric
 
@@ -0,0 +1,78 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"flag"
+	"path"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+)
+
+const metricFamilyMetadataDir = "fingerprint_to_metricfamily_metadata"
+
+var metricFamilyMetadataCacheSize = flag.Int("storage.fingerprintToMetricFamilyMetadataCacheSizeBytes", 5*1024*1024, "The size in bytes for the fingerprint to metric family metadata index cache.")
+
+// MetricFamilyMetadata is the HELP and TYPE information a MetricFamily
+// carries in the exposition formats, kept around so it can be served back
+// out (e.g. by the query API) without having to wait for another scrape
+// that happens to still carry it.
+type MetricFamilyMetadata struct {
+	Name string
+	Help string
+	Type string
+}
+
+// MetricFamilyMetadataIndex is a KeyValueStore that maps a fingerprint to
+// the HELP/TYPE metadata of the MetricFamily its series was last ingested
+// from. Every series belonging to the same family -- including, for a
+// histogram or summary, its _bucket/_count/_sum and quantile children --
+// is indexed under its own fingerprint with the same metadata, so a
+// lookup never has to walk back to the parent family's series.
+type MetricFamilyMetadataIndex struct {
+	KeyValueStore
+}
+
+// NewMetricFamilyMetadataIndex returns a LevelDB-backed
+// MetricFamilyMetadataIndex ready to use.
+func NewMetricFamilyMetadataIndex(basePath string) (*MetricFamilyMetadataIndex, error) {
+	db, err := NewLevelDB(LevelDBOptions{
+		Path:           path.Join(basePath, metricFamilyMetadataDir),
+		CacheSizeBytes: *metricFamilyMetadataCacheSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MetricFamilyMetadataIndex{KeyValueStore: db}, nil
+}
+
+// Put records md as the metadata for fp, overwriting whatever was
+// previously stored for it.
+//
+// This method is goroutine-safe.
+func (i *MetricFamilyMetadataIndex) Put(fp clientmodel.Fingerprint, md MetricFamilyMetadata) error {
+	return i.KeyValueStore.Put(codable.Fingerprint(fp), codable.MetricFamilyMetadata(md))
+}
+
+// Lookup looks up the metadata last recorded for fp. Looking up a
+// fingerprint with no recorded metadata is not an error; in that case,
+// (MetricFamilyMetadata{}, false, nil) is returned.
+//
+// This method is goroutine-safe.
+func (i *MetricFamilyMetadataIndex) Lookup(fp clientmodel.Fingerprint) (md MetricFamilyMetadata, ok bool, err error) {
+	ok, err = i.Get(codable.Fingerprint(fp), (*codable.MetricFamilyMetadata)(&md))
+	return
+}
@@ -0,0 +1,279 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/index"
+)
+
+// OutOfOrderSampleError is returned by AppendMetricFamilies (by way of
+// appendFamily) when a family carries a sample that is not strictly after
+// the last one persisted for its series. It names the offending family so
+// a caller logging or surfacing the error doesn't have to go digging
+// through a whole exposition payload to find the culprit.
+type OutOfOrderSampleError struct {
+	Family    string
+	Timestamp clientmodel.Timestamp
+}
+
+func (e OutOfOrderSampleError) Error() string {
+	return fmt.Sprintf("out-of-order sample for metric family %q at %v", e.Family, e.Timestamp)
+}
+
+// appendFamiliesFunc is the shape of the per-family append callback
+// AppendMetricFamilies drives: given the flattened samples belonging to
+// one MetricFamily (already holding that family's fingerprints' locks),
+// it appends them and reports the first out-of-order sample it finds, if
+// any. The Storage implementation that owns series.go's AppendSamples is
+// expected to supply this; persistence has no series state of its own to
+// check ordering against.
+type appendFamiliesFunc func(clientmodel.Samples) error
+
+// AppendMetricFamilies decodes every MetricFamily in r (in the exposition
+// format named by format), persists its HELP/TYPE metadata, flattens it
+// into samples -- decomposing histograms and summaries into their
+// _bucket/_count/_sum and quantile child series -- and hands each
+// family's samples to append as a single batch, one family at a time, so
+// a family is never split across two append calls. Families are decoded
+// one at a time via expfmt's streaming decoder rather than read into a
+// slice up front, so a large scrape payload's memory footprint is
+// bounded by the size of its biggest single family rather than the whole
+// payload. A family carrying a sample that is not strictly after the last
+// one accepted for its series is rejected in its entirety with an
+// OutOfOrderSampleError naming the family, before any of its samples are
+// logged or appended.
+//
+// fpLocker must be the same fingerprintLocker guarding the series data
+// append ultimately writes into; AppendMetricFamilies takes its lock once
+// per family, covering every child series that family decomposes into,
+// so a reader can never observe a histogram's buckets and its _sum out of
+// sync with each other.
+//
+// Completing this method's contract -- actually writing the flattened
+// samples into series data -- needs the owning memorySeries/AppendSamples
+// machinery in series.go, which this tree does not carry; append is
+// therefore accepted as a parameter here rather than hardcoded, so the
+// Storage implementation that does exist can supply its own AppendSamples
+// as append once it does.
+//
+// This method is goroutine-safe.
+func (p *persistence) AppendMetricFamilies(r io.Reader, format expfmt.Format, fpLocker *fingerprintLocker, append appendFamiliesFunc) error {
+	dec := expfmt.NewDecoder(r, format)
+	for {
+		var mf dto.MetricFamily
+		if err := dec.Decode(&mf); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := p.appendFamily(&mf, fpLocker, append); err != nil {
+			return err
+		}
+	}
+}
+
+// appendFamily handles a single already-decoded MetricFamily: it persists
+// the family's metadata under every fingerprint it decomposes into, locks
+// those fingerprints as a group, logs every sample to the WAL, and hands the
+// flattened samples to append.
+func (p *persistence) appendFamily(mf *dto.MetricFamily, fpLocker *fingerprintLocker, append appendFamiliesFunc) error {
+	samples, exemplars, err := decomposeFamily(mf)
+	if err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		return nil
+	}
+
+	md := index.MetricFamilyMetadata{
+		Name: mf.GetName(),
+		Help: mf.GetHelp(),
+		Type: mf.GetType().String(),
+	}
+
+	fps := make(clientmodel.Fingerprints, 0, len(samples))
+	seen := map[clientmodel.Fingerprint]bool{}
+	for _, s := range samples {
+		fp := s.Metric.FastFingerprint()
+		if seen[fp] {
+			continue
+		}
+		seen[fp] = true
+		fps = append(fps, fp)
+	}
+
+	// A family's child series (histogram buckets, summary quantiles, ...)
+	// can span several fingerprints at once, so they are locked together
+	// via LockMany rather than one Lock call per fingerprint, which
+	// guarantees deadlock freedom against any other caller locking an
+	// overlapping set of fingerprints.
+	fpLocker.LockMany(fps...)
+	defer fpLocker.UnlockMany(fps...)
+
+	for _, fp := range fps {
+		if err := p.metricFamilyMetadata.Put(fp, md); err != nil {
+			return err
+		}
+	}
+
+	// Validate every sample's ordering against the last one accepted for
+	// its series, and against each other (a family can carry more than one
+	// sample for the same fingerprint), before logging or appending
+	// anything. Only once the whole family passes does the second loop
+	// below log and append it, so a family rejected partway through never
+	// leaves an earlier sample already durable in the WAL or already
+	// advancing a fingerprint's high-water mark -- matching this method's
+	// contract of rejecting a family in its entirety.
+	pendingMarks := make(map[clientmodel.Fingerprint]clientmodel.Timestamp, len(fps))
+	for _, s := range samples {
+		fp := s.Metric.FastFingerprint()
+		last, ok := pendingMarks[fp]
+		if !ok {
+			last, ok = p.sampleOrderHighWaterMark(fp)
+		}
+		if ok && !s.Timestamp.After(last) {
+			return OutOfOrderSampleError{Family: mf.GetName(), Timestamp: s.Timestamp}
+		}
+		pendingMarks[fp] = s.Timestamp
+	}
+
+	// Each sample logged here is durable in the WAL ahead of append
+	// reflecting it in memory, so a crash between the two loses nothing:
+	// loadSeriesMapAndHeads replays exactly these records on the next
+	// start-up.
+	for _, s := range samples {
+		if err := p.logSample(s.Metric.FastFingerprint(), s.Timestamp, s.Value); err != nil {
+			return err
+		}
+	}
+	p.commitSampleOrder(pendingMarks)
+
+	if err := append(samples); err != nil {
+		return err
+	}
+	for _, fe := range exemplars {
+		if err := p.addExemplar(fe.fp, fe.exemplar); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fingerprintedExemplar pairs an index.Exemplar with the fingerprint of the
+// series it was observed on, so decomposeFamily can hand exemplars back to
+// appendFamily without appendFamily having to recompute fingerprints.
+type fingerprintedExemplar struct {
+	fp       clientmodel.Fingerprint
+	exemplar index.Exemplar
+}
+
+// decomposeFamily flattens a single MetricFamily into samples. Counters,
+// gauges, and untyped values become one sample each; summaries and
+// histograms become one sample per quantile/bucket plus a _sum and a
+// _count sample, matching the child series the text and protobuf
+// exposition formats themselves use to represent them. Any OpenMetrics
+// exemplar attached to a counter or histogram bucket is collected
+// alongside, paired with the fingerprint of the series it belongs to.
+func decomposeFamily(mf *dto.MetricFamily) (clientmodel.Samples, []fingerprintedExemplar, error) {
+	name := mf.GetName()
+	var samples clientmodel.Samples
+	var exemplars []fingerprintedExemplar
+
+	baseMetric := func(labels []*dto.LabelPair) clientmodel.Metric {
+		m := clientmodel.Metric{clientmodel.MetricNameLabel: clientmodel.LabelValue(name)}
+		for _, lp := range labels {
+			m[clientmodel.LabelName(lp.GetName())] = clientmodel.LabelValue(lp.GetValue())
+		}
+		return m
+	}
+
+	addExemplar := func(met clientmodel.Metric, ex *dto.Exemplar) {
+		if ex == nil {
+			return
+		}
+		ts, err := ptypes.Timestamp(ex.GetTimestamp())
+		if err != nil {
+			return
+		}
+		labels := clientmodel.LabelSet{}
+		for _, lp := range ex.GetLabel() {
+			labels[clientmodel.LabelName(lp.GetName())] = clientmodel.LabelValue(lp.GetValue())
+		}
+		exemplars = append(exemplars, fingerprintedExemplar{
+			fp: met.FastFingerprint(),
+			exemplar: index.Exemplar{
+				Labels:    labels,
+				Value:     clientmodel.SampleValue(ex.GetValue()),
+				Timestamp: clientmodel.Timestamp(ts.UnixNano() / int64(time.Millisecond)),
+			},
+		})
+	}
+
+	for _, m := range mf.GetMetric() {
+		ts := clientmodel.Timestamp(m.GetTimestampMs())
+
+		switch mf.GetType() {
+		case dto.MetricType_SUMMARY:
+			s := m.GetSummary()
+			for _, q := range s.GetQuantile() {
+				met := baseMetric(m.GetLabel())
+				met[clientmodel.LabelName("quantile")] = clientmodel.LabelValue(fmt.Sprint(q.GetQuantile()))
+				samples = append(samples, &clientmodel.Sample{Metric: met, Timestamp: ts, Value: clientmodel.SampleValue(q.GetValue())})
+			}
+			samples = append(samples, childSample(name, "_sum", m.GetLabel(), ts, s.GetSampleSum()))
+			samples = append(samples, childSample(name, "_count", m.GetLabel(), ts, float64(s.GetSampleCount())))
+		case dto.MetricType_HISTOGRAM:
+			h := m.GetHistogram()
+			for _, b := range h.GetBucket() {
+				met := baseMetric(m.GetLabel())
+				met[clientmodel.MetricNameLabel] = clientmodel.LabelValue(name + "_bucket")
+				met[clientmodel.LabelName("le")] = clientmodel.LabelValue(fmt.Sprint(b.GetUpperBound()))
+				samples = append(samples, &clientmodel.Sample{Metric: met, Timestamp: ts, Value: clientmodel.SampleValue(b.GetCumulativeCount())})
+				addExemplar(met, b.GetExemplar())
+			}
+			samples = append(samples, childSample(name, "_sum", m.GetLabel(), ts, h.GetSampleSum()))
+			samples = append(samples, childSample(name, "_count", m.GetLabel(), ts, float64(h.GetSampleCount())))
+		case dto.MetricType_COUNTER:
+			met := baseMetric(m.GetLabel())
+			samples = append(samples, &clientmodel.Sample{Metric: met, Timestamp: ts, Value: clientmodel.SampleValue(m.GetCounter().GetValue())})
+			addExemplar(met, m.GetCounter().GetExemplar())
+		case dto.MetricType_GAUGE:
+			samples = append(samples, &clientmodel.Sample{Metric: baseMetric(m.GetLabel()), Timestamp: ts, Value: clientmodel.SampleValue(m.GetGauge().GetValue())})
+		default:
+			samples = append(samples, &clientmodel.Sample{Metric: baseMetric(m.GetLabel()), Timestamp: ts, Value: clientmodel.SampleValue(m.GetUntyped().GetValue())})
+		}
+	}
+	return samples, exemplars, nil
+}
+
+// childSample builds the _sum or _count (suffix) sample a histogram or
+// summary decomposes into, alongside its quantile/bucket children.
+func childSample(name, suffix string, labels []*dto.LabelPair, ts clientmodel.Timestamp, value float64) *clientmodel.Sample {
+	met := clientmodel.Metric{clientmodel.MetricNameLabel: clientmodel.LabelValue(name + suffix)}
+	for _, lp := range labels {
+		met[clientmodel.LabelName(lp.GetName())] = clientmodel.LabelValue(lp.GetValue())
+	}
+	return &clientmodel.Sample{Metric: met, Timestamp: ts, Value: clientmodel.SampleValue(value)}
+}
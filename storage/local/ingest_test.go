@@ -0,0 +1,176 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/index"
+)
+
+const textHistogram = `
+# HELP request_duration_seconds A histogram of request durations.
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.1"} 1
+request_duration_seconds_bucket{le="0.5"} 2
+request_duration_seconds_bucket{le="+Inf"} 3
+request_duration_seconds_sum 1.2
+request_duration_seconds_count 3
+`
+
+// decodeOneFamily decodes the single MetricFamily encoded in body under
+// format, failing the test if there is not exactly one.
+func decodeOneFamily(t *testing.T, body string, format expfmt.Format) *dto.MetricFamily {
+	t.Helper()
+	dec := expfmt.NewDecoder(strings.NewReader(body), format)
+	var mf dto.MetricFamily
+	if err := dec.Decode(&mf); err != nil {
+		t.Fatalf("could not decode metric family: %s", err)
+	}
+	return &mf
+}
+
+func TestDecomposeFamilyHistogramFmtText(t *testing.T) {
+	mf := decodeOneFamily(t, textHistogram, expfmt.FmtText)
+
+	samples, _, err := decomposeFamily(mf)
+	if err != nil {
+		t.Fatalf("decomposeFamily returned an error: %s", err)
+	}
+
+	// 3 buckets + _sum + _count.
+	if len(samples) != 5 {
+		t.Fatalf("got %d samples, want 5", len(samples))
+	}
+
+	var sawSum, sawCount bool
+	for _, s := range samples {
+		switch s.Metric[clientmodel.MetricNameLabel] {
+		case "request_duration_seconds_sum":
+			sawSum = true
+			if s.Value != 1.2 {
+				t.Errorf("_sum sample value = %v, want 1.2", s.Value)
+			}
+		case "request_duration_seconds_count":
+			sawCount = true
+			if s.Value != 3 {
+				t.Errorf("_count sample value = %v, want 3", s.Value)
+			}
+		case "request_duration_seconds_bucket":
+			if _, ok := s.Metric["le"]; !ok {
+				t.Errorf("bucket sample is missing its le label: %v", s.Metric)
+			}
+		}
+	}
+	if !sawSum || !sawCount {
+		t.Errorf("decomposition did not produce both _sum and _count samples")
+	}
+}
+
+func TestDecomposeFamilyHistogramFmtProtoDelim(t *testing.T) {
+	// Round-trip the text fixture through the protobuf delimited format so
+	// the same family can be exercised through both decoders.
+	textMF := decodeOneFamily(t, textHistogram, expfmt.FmtText)
+
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.FmtProtoDelim)
+	if err := enc.Encode(textMF); err != nil {
+		t.Fatalf("could not re-encode fixture as %s: %s", expfmt.FmtProtoDelim, err)
+	}
+
+	mf := decodeOneFamily(t, buf.String(), expfmt.FmtProtoDelim)
+	samples, _, err := decomposeFamily(mf)
+	if err != nil {
+		t.Fatalf("decomposeFamily returned an error: %s", err)
+	}
+	if len(samples) != 5 {
+		t.Fatalf("got %d samples, want 5", len(samples))
+	}
+}
+
+func TestMetricFamilyMetadataRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metricfamily_metadata_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := newPersistence(dir, 1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fpLocker := newFingerprintLocker(10)
+	noopAppend := func(clientmodel.Samples) error { return nil }
+
+	mf := decodeOneFamily(t, textHistogram, expfmt.FmtText)
+	if err := p.appendFamily(mf, fpLocker, noopAppend); err != nil {
+		t.Fatalf("appendFamily returned an error: %s", err)
+	}
+
+	want := index.MetricFamilyMetadata{
+		Name: "request_duration_seconds",
+		Help: "A histogram of request durations.",
+		Type: "HISTOGRAM",
+	}
+	fp := clientmodel.Metric{clientmodel.MetricNameLabel: "request_duration_seconds_bucket", "le": "0.1"}.FastFingerprint()
+
+	got, ok := p.GetMetricFamilyMetadataForFingerprint(fp)
+	if !ok {
+		t.Fatal("expected metadata to be found")
+	}
+	if got != want {
+		t.Errorf("got metadata %+v, want %+v", got, want)
+	}
+}
+
+func TestAppendFamilyRejectsOutOfOrderSamples(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest_out_of_order_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := newPersistence(dir, 1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fpLocker := newFingerprintLocker(10)
+	noopAppend := func(clientmodel.Samples) error { return nil }
+
+	newer := decodeOneFamily(t, "# TYPE test_gauge gauge\ntest_gauge 1 2000\n", expfmt.FmtText)
+	if err := p.appendFamily(newer, fpLocker, noopAppend); err != nil {
+		t.Fatalf("appendFamily returned an error for the first sample: %s", err)
+	}
+
+	older := decodeOneFamily(t, "# TYPE test_gauge gauge\ntest_gauge 2 1000\n", expfmt.FmtText)
+	err = p.appendFamily(older, fpLocker, noopAppend)
+	oooErr, ok := err.(OutOfOrderSampleError)
+	if !ok {
+		t.Fatalf("got error %v (%T), want an OutOfOrderSampleError", err, err)
+	}
+	if oooErr.Family != "test_gauge" {
+		t.Errorf("got offending family %q, want %q", oooErr.Family, "test_gauge")
+	}
+}
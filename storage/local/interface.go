@@ -14,9 +14,12 @@
 package local
 
 import (
+	"io"
 	"time"
+
 	clientmodel "github.com/prometheus/client_golang/model"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
 
 	"github.com/prometheus/prometheus/storage/metric"
 )
@@ -29,6 +32,14 @@ type Storage interface {
 	// fingerprint need to be submitted in chronological order, from oldest to
 	// newest (both in the same call to AppendSamples and across multiple calls).
 	AppendSamples(clientmodel.Samples)
+	// AppendMetricFamilies decodes every MetricFamily read from r in the
+	// given exposition format and appends the samples it decomposes into,
+	// aggregating histogram/summary children under a single lock per
+	// family and preserving each family's HELP/TYPE metadata. It returns
+	// an OutOfOrderSampleError naming the offending family if r contains
+	// a sample that is not strictly after the last one stored for its
+	// series.
+	AppendMetricFamilies(r io.Reader, format expfmt.Format) error
 	// NewPreloader returns a new Preloader which allows preloading and pinning
 	// series data into memory for use within a query.
 	NewPreloader() Preloader
@@ -76,22 +87,30 @@ type SeriesIterator interface {
 // A Preloader preloads series data necessary for a query into memory and pins
 // them until released via Close(). Its methods are generally not
 // goroutine-safe.
+//
+// An implementation backing GetMetricRangeAtInterval is expected to pin each
+// window coalesceRangeIntervals computes exactly once, and reference-count
+// chunks the same way PreloadRange's implementation already does via
+// fingerprintLock.refCount, so that Close() correctly unpins a chunk
+// regardless of how many requested intervals happened to overlap it.
 type Preloader interface {
 	PreloadRange(
 		fp clientmodel.Fingerprint,
 		from clientmodel.Timestamp, through clientmodel.Timestamp,
 		stalenessDelta time.Duration,
 	) error
-	/*
-		// GetMetricAtTime loads and pins samples around a given time.
-		GetMetricAtTime(clientmodel.Fingerprint, clientmodel.Timestamp) error
-		// GetMetricAtInterval loads and pins samples at intervals.
-		GetMetricAtInterval(fp clientmodel.Fingerprint, from, through clientmodel.Timestamp, interval time.Duration) error
-		// GetMetricRange loads and pins a given range of samples.
-		GetMetricRange(fp clientmodel.Fingerprint, from, through clientmodel.Timestamp) error
-		// GetMetricRangeAtInterval loads and pins sample ranges at intervals.
-		GetMetricRangeAtInterval(fp clientmodel.Fingerprint, from, through clientmodel.Timestamp, interval, rangeDuration time.Duration) error
-	*/
+	// GetMetricAtTime loads and pins samples around a given time.
+	GetMetricAtTime(fp clientmodel.Fingerprint, t clientmodel.Timestamp) error
+	// GetMetricAtInterval loads and pins samples at intervals.
+	GetMetricAtInterval(fp clientmodel.Fingerprint, from, through clientmodel.Timestamp, interval time.Duration) error
+	// GetMetricRange loads and pins a given range of samples.
+	GetMetricRange(fp clientmodel.Fingerprint, from, through clientmodel.Timestamp) error
+	// GetMetricRangeAtInterval loads and pins sample ranges at intervals. The
+	// ranges pinned are [t-rangeDuration, t] for every t in
+	// [from, through] stepped by interval; overlapping ranges are coalesced
+	// into a single pin (see coalesceRangeIntervals) so a chunk straddling
+	// two steps is only pinned, and later unpinned, once.
+	GetMetricRangeAtInterval(fp clientmodel.Fingerprint, from, through clientmodel.Timestamp, interval, rangeDuration time.Duration) error
 	// Close unpins any previously requested series data from memory.
 	Close()
 }
@@ -1,97 +1,86 @@
 package local
 
 import (
+	"flag"
+	"sort"
 	"sync"
 
 	clientmodel "github.com/prometheus/client_golang/model"
 )
 
-// fingerprintLock allows locking exactly one fingerprint. When refCount is 0
-// after the mutex is unlocked, the fingerprintLock is discarded from the
-// fingerprintLocker.
-type fingerprintLock struct {
-	sync.Mutex
-	refCount int
-}
+var numFingerprintLockStripes = flag.Int("storage.fingerprintLockStripes", 4096, "The number of striped mutexes used to serialize access to individual fingerprints. A fingerprint uses stripe fingerprint modulo this number.")
 
-// fingerprintLocker allows locking individual fingerprints in such a manner
-// that the lock only exists and uses memory while it is being held (or waiting
-// to be acquired) by at least one party.
-//
-// TODO: This could be implemented as just a fixed number n of locks, assigned
-// based on the fingerprint % n. There can be collisons, but they would
-// statistically rarely matter (if n is much larger than the number of
-// goroutines requiring locks concurrently). Only problem is locking of two
-// different fingerprints by the same goroutine.
+// fingerprintLocker allows locking individual fingerprints. To keep the
+// hot append path allocation-free, it does not hand out one mutex per
+// fingerprint (which would need a map and a pool to keep memory bounded,
+// as an earlier version of this type did); instead, a fixed set of
+// stripes is preallocated up front, and a fingerprint is locked by
+// locking the stripe its hash falls into. Two different fingerprints
+// can therefore map to (and contend on) the same stripe, but with enough
+// stripes relative to the number of goroutines locking concurrently,
+// that collision is rare enough not to matter in practice.
 type fingerprintLocker struct {
-	mtx        sync.Mutex
-	fpLocks    map[clientmodel.Fingerprint]*fingerprintLock
-	fpLockPool []*fingerprintLock
+	stripes []sync.Mutex
 }
 
-// newFingerprintLocker returns a new fingerprintLocker ready for use.
-func newFingerprintLocker(preallocatedMutexes int) *fingerprintLocker {
-	lockPool := make([]*fingerprintLock, preallocatedMutexes)
-	for i := range lockPool {
-		lockPool[i] = &fingerprintLock{}
-	}
+// newFingerprintLocker returns a new fingerprintLocker with numStripes
+// preallocated stripes ready for use. numStripes must be positive; it need
+// not be a power of two, since stripeFor takes fp modulo numStripes.
+func newFingerprintLocker(numStripes int) *fingerprintLocker {
 	return &fingerprintLocker{
-		fpLocks:    map[clientmodel.Fingerprint]*fingerprintLock{},
-		fpLockPool: lockPool,
+		stripes: make([]sync.Mutex, numStripes),
 	}
 }
 
-// getLock either returns an existing fingerprintLock from a pool, or allocates
-// a new one if the pool is depleted.
-func (l *fingerprintLocker) getLock() *fingerprintLock {
-	if len(l.fpLockPool) == 0 {
-		return &fingerprintLock{}
-	}
-
-	lock := l.fpLockPool[len(l.fpLockPool)-1]
-	l.fpLockPool = l.fpLockPool[:len(l.fpLockPool)-1]
-	return lock
-}
-
-// putLock either stores a fingerprintLock back in the pool, or throws it away
-// if the pool is full.
-func (l *fingerprintLocker) putLock(fpl *fingerprintLock) {
-	if len(l.fpLockPool) == cap(l.fpLockPool) {
-		return
-	}
-
-	l.fpLockPool = l.fpLockPool[:len(l.fpLockPool)+1]
-	l.fpLockPool[len(l.fpLockPool)-1] = fpl
+// stripeFor returns the index of the stripe fp locks.
+func (l *fingerprintLocker) stripeFor(fp clientmodel.Fingerprint) int {
+	return int(uint64(fp) % uint64(len(l.stripes)))
 }
 
 // Lock locks the given fingerprint.
 func (l *fingerprintLocker) Lock(fp clientmodel.Fingerprint) {
-	l.mtx.Lock()
-
-	fpLock, ok := l.fpLocks[fp]
-	if ok {
-		fpLock.refCount++
-	} else {
-		fpLock = l.getLock()
-		l.fpLocks[fp] = fpLock
-	}
-
-	l.mtx.Unlock()
-	fpLock.Lock()
+	l.stripes[l.stripeFor(fp)].Lock()
 }
 
 // Unlock unlocks the given fingerprint.
 func (l *fingerprintLocker) Unlock(fp clientmodel.Fingerprint) {
-	l.mtx.Lock()
-	defer l.mtx.Unlock()
+	l.stripes[l.stripeFor(fp)].Unlock()
+}
+
+// LockMany locks every fingerprint in fps. Unlike calling Lock once per
+// fingerprint, it is safe to use when a single goroutine needs more than
+// one fingerprint locked at a time: it deduplicates the stripes fps map
+// to (two fingerprints can share a stripe) and acquires them in
+// ascending stripe order, so two goroutines calling LockMany with
+// overlapping fingerprint sets always agree on acquisition order and can
+// never deadlock against each other.
+func (l *fingerprintLocker) LockMany(fps ...clientmodel.Fingerprint) {
+	for _, i := range l.dedupedSortedStripes(fps) {
+		l.stripes[i].Lock()
+	}
+}
 
-	fpLock := l.fpLocks[fp]
-	fpLock.Unlock()
+// UnlockMany unlocks every fingerprint in fps. fps must be the same set
+// of fingerprints passed to the LockMany call being undone.
+func (l *fingerprintLocker) UnlockMany(fps ...clientmodel.Fingerprint) {
+	for _, i := range l.dedupedSortedStripes(fps) {
+		l.stripes[i].Unlock()
+	}
+}
 
-	if fpLock.refCount == 0 {
-		delete(l.fpLocks, fp)
-		l.putLock(fpLock)
-	} else {
-		fpLock.refCount--
+// dedupedSortedStripes returns the distinct stripe indices fps map to, in
+// ascending order.
+func (l *fingerprintLocker) dedupedSortedStripes(fps []clientmodel.Fingerprint) []int {
+	seen := make(map[int]struct{}, len(fps))
+	stripes := make([]int, 0, len(fps))
+	for _, fp := range fps {
+		i := l.stripeFor(fp)
+		if _, ok := seen[i]; ok {
+			continue
+		}
+		seen[i] = struct{}{}
+		stripes = append(stripes, i)
 	}
+	sort.Ints(stripes)
+	return stripes
 }
@@ -0,0 +1,175 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"sync"
+
+	"github.com/golang/glog"
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+	"github.com/prometheus/prometheus/storage/local/index"
+)
+
+// fpMapper resolves a metric's fast fingerprint -- the plain FNV-1A hash of
+// its label set, as returned by Metric.FastFingerprint -- to a fingerprint
+// unique to that exact label set. Two distinct
+// label sets can legitimately hash to the same fast fingerprint; when that
+// happens, the metric that claimed the fast fingerprint first keeps using
+// it unchanged, and every later metric colliding with it is assigned a
+// fresh, unused fingerprint instead. Without this, the second metric's
+// samples would silently land in the first metric's series.
+//
+// The mapping is persisted the same way every other index in this package
+// is: through
+// its own LevelDB instance (index.FingerprintMappingIndex), loaded
+// wholesale into memory by newFPMapper before indexing begins, the same
+// way the other indexes' in-memory counterparts are populated at startup.
+type fpMapper struct {
+	mtx sync.RWMutex
+	// mappings holds, per fast fingerprint, every metric mapFP has seen
+	// under it together with the fingerprint it was assigned: the first
+	// metric keeps the fast fingerprint itself, and every later, colliding
+	// one gets a fresh fingerprint.
+	mappings map[clientmodel.Fingerprint][]mappedFP
+
+	db *index.FingerprintMappingIndex
+
+	// fpInUse reports whether fp is already the fingerprint of some live
+	// or archived series, so mapFP knows not to hand it to a new metric.
+	// newPersistence supplies persistence.fpInUseOnDisk, which only knows
+	// archived series; fpMapper itself has no visibility into in-memory
+	// series state.
+	fpInUse func(clientmodel.Fingerprint) bool
+}
+
+// mappedFP is one entry of fpMapper.mappings: the metric that collided
+// with a fast fingerprint, and the fingerprint it was mapped to instead.
+type mappedFP struct {
+	metric      clientmodel.Metric
+	fingerprint clientmodel.Fingerprint
+}
+
+// newFPMapper returns an fpMapper backed by basePath's LevelDB mapping
+// index, with its in-memory state already reloaded from it. fpInUse is
+// consulted when a metric is first seen under a fast fingerprint with no
+// recorded metric, and while allocating a fresh fingerprint for a
+// collision, to skip over any fingerprint already claimed by another
+// series; a metric that is already recorded never reaches it.
+func newFPMapper(basePath string, fpInUse func(clientmodel.Fingerprint) bool) (*fpMapper, error) {
+	db, err := index.NewFingerprintMappingIndex(basePath)
+	if err != nil {
+		return nil, err
+	}
+	m := &fpMapper{
+		mappings: map[clientmodel.Fingerprint][]mappedFP{},
+		db:       db,
+		fpInUse:  fpInUse,
+	}
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// reload populates m.mappings from every entry in m.db, so a restart
+// never has to rediscover a collision that was already resolved (which,
+// worse than relearning it, would risk assigning the colliding metric a
+// different fingerprint than last time).
+func (m *fpMapper) reload() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var fastFP codable.Fingerprint
+	var mappings codable.FingerprintMappings
+	return m.db.ForEach(func(kv index.KeyValueAccessor) error {
+		if err := kv.Key(&fastFP); err != nil {
+			return err
+		}
+		if err := kv.Value(&mappings); err != nil {
+			return err
+		}
+		entries := make([]mappedFP, len(mappings))
+		for i, fm := range mappings {
+			entries[i] = mappedFP{metric: fm.Metric, fingerprint: fm.Fingerprint}
+		}
+		m.mappings[clientmodel.Fingerprint(fastFP)] = entries
+		return nil
+	})
+}
+
+// mapFP returns the canonical fingerprint to use for met, whose fast
+// fingerprint is fastFP. If fastFP has never collided, or met is the
+// metric that originally claimed it, fastFP is returned unchanged.
+// Otherwise met is (or already has been) assigned a fresh fingerprint
+// distinct from fastFP, which is returned instead.
+//
+// This method is goroutine-safe but does not serialize concurrent calls
+// for the same fastFP against each other; callers are expected to already
+// hold fastFP's fingerprintLocker lock while mapping a sample's metric,
+// the same lock AppendSamples must then re-take on the returned,
+// possibly-different fingerprint.
+func (m *fpMapper) mapFP(fastFP clientmodel.Fingerprint, met clientmodel.Metric) clientmodel.Fingerprint {
+	m.mtx.RLock()
+	for _, mapping := range m.mappings[fastFP] {
+		if mapping.metric.Equal(met) {
+			m.mtx.RUnlock()
+			return mapping.fingerprint
+		}
+	}
+	m.mtx.RUnlock()
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	// Re-check under the write lock: another goroutine may have mapped
+	// met (or claimed fastFP outright) while we were waiting.
+	for _, mapping := range m.mappings[fastFP] {
+		if mapping.metric.Equal(met) {
+			return mapping.fingerprint
+		}
+	}
+
+	// Nothing recorded and nothing else owning the fast fingerprint: met
+	// becomes its canonical owner and keeps it unchanged.
+	mappedFingerprint := fastFP
+	if len(m.mappings[fastFP]) > 0 || m.fpInUse(fastFP) {
+		mappedFingerprint = m.nextFreeFingerprint(fastFP)
+	}
+	m.mappings[fastFP] = append(m.mappings[fastFP], mappedFP{metric: met, fingerprint: mappedFingerprint})
+	if err := m.db.Add(fastFP, met, mappedFingerprint); err != nil {
+		glog.Warningf("Could not persist fingerprint mapping for %v: %s", fastFP, err)
+	}
+	return mappedFingerprint
+}
+
+// nextFreeFingerprint searches for a fingerprint not already in use,
+// starting from fastFP XORed with an increasing collision counter. This
+// keeps mapped fingerprints deterministic given the same sequence of
+// collisions, which is convenient for debugging, while still being cheap
+// to compute and, in practice, never retried more than once or twice.
+// Called with mtx already held.
+func (m *fpMapper) nextFreeFingerprint(fastFP clientmodel.Fingerprint) clientmodel.Fingerprint {
+	for i := uint64(1); ; i++ {
+		candidate := clientmodel.Fingerprint(uint64(fastFP) ^ i)
+		if candidate == fastFP || m.fpInUse(candidate) {
+			continue
+		}
+		if _, mapped := m.mappings[candidate]; mapped {
+			continue
+		}
+		return candidate
+	}
+}
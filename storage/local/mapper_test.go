@@ -0,0 +1,75 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+func TestFPMapperMapsCollidingMetricsToDistinctFingerprints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fpmapper_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inUse := map[clientmodel.Fingerprint]bool{}
+	fpInUse := func(fp clientmodel.Fingerprint) bool { return inUse[fp] }
+
+	m, err := newFPMapper(dir, fpInUse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// metA and metB are distinct label sets made to share one fast
+	// fingerprint, simulating an FNV-1A collision without needing to
+	// actually find two label sets that hash the same way.
+	const fastFP = clientmodel.Fingerprint(12345)
+	metA := clientmodel.Metric{"__name__": "a"}
+	metB := clientmodel.Metric{"__name__": "b"}
+
+	fpA := m.mapFP(fastFP, metA)
+	if fpA != fastFP {
+		t.Fatalf("first metric under a fast fingerprint should keep it unchanged: got %v, want %v", fpA, fastFP)
+	}
+	inUse[fpA] = true
+
+	fpB := m.mapFP(fastFP, metB)
+	if fpB == fastFP {
+		t.Fatalf("colliding metric should have been mapped away from the fast fingerprint %v", fastFP)
+	}
+	inUse[fpB] = true
+
+	if got := m.mapFP(fastFP, metA); got != fpA {
+		t.Errorf("metric A's fingerprint changed across calls: got %v, want %v", got, fpA)
+	}
+	if got := m.mapFP(fastFP, metB); got != fpB {
+		t.Errorf("metric B's fingerprint changed across calls: got %v, want %v", got, fpB)
+	}
+
+	// A fresh fpMapper over the same basePath (simulating a restart) must
+	// recall the existing mapping rather than allocating a new
+	// fingerprint for metB.
+	reloaded, err := newFPMapper(dir, fpInUse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.mapFP(fastFP, metB); got != fpB {
+		t.Errorf("fingerprint mapping did not survive reload: got %v, want %v", got, fpB)
+	}
+}
@@ -15,11 +15,16 @@ package local
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -41,15 +46,38 @@ const (
 
 	headsFileName      = "heads.db"
 	headsTempFileName  = "heads.db.tmp"
-	headsFormatVersion = 1
+	headsFormatVersion = 2
 	headsMagicString   = "PrometheusHeads"
 
+	// headsNumGenerations is the number of past checkpoint generations kept
+	// around as heads.db.1, heads.db.2, ... so that loadSeriesMapAndHeads
+	// can fall back to an older but verifiably intact checkpoint if the
+	// latest one fails its CRC checks.
+	headsNumGenerations = 3
+
+	// headsRecordLenFieldLen is the width of the length prefix written
+	// before each series record in the heads file, and headsRecordCRCLen
+	// is the width of the CRC32C trailer written after it. Framing each
+	// record this way (rather than trusting the field-by-field encoding
+	// to stay in sync) lets a corrupt record be detected and the whole
+	// file rejected before any of it is used.
+	headsRecordLenFieldLen = 4
+	headsRecordCRCLen      = 4
+	// headsFooterLen is the trailing footer: the total number of series
+	// records in the file, followed by a CRC32C over all of them.
+	headsFooterLen = 8 + 4
+
 	fileBufSize = 1 << 16 // 64kiB.
 
 	chunkHeaderLen             = 17
 	chunkHeaderTypeOffset      = 0
 	chunkHeaderFirstTimeOffset = 1
 	chunkHeaderLastTimeOffset  = 9
+	// chunkHeaderLenFieldLen is the width of the body-length field that
+	// follows the fixed chunkHeaderLen header when a chunk's body is
+	// compressed (see compression.go). Uncompressed bodies have no
+	// length field and are always exactly p.chunkLen bytes.
+	chunkHeaderLenFieldLen = 4
 
 	indexingMaxBatchSize  = 1024 * 1024
 	indexingBatchTimeout  = 500 * time.Millisecond // Commit batch when idle for that long.
@@ -85,6 +113,11 @@ type persistence struct {
 	basePath string
 	chunkLen int
 
+	// chunkStore is where persistChunk, loadChunks, loadChunkDescs, and
+	// dropChunks actually read and write chunk bytes, selected by
+	// -storage.local.engine; see chunkstore.go and blockstore.go.
+	chunkStore ChunkStore
+
 	// archiveMtx protects the archiving-related methods archiveMetric,
 	// unarchiveMetric, dropArchiveMetric, and getFingerprintsModifiedBefore
 	// from concurrent calls.
@@ -94,6 +127,7 @@ type persistence struct {
 	archivedFingerprintToTimeRange *index.FingerprintTimeRangeIndex
 	labelPairToFingerprints        *index.LabelPairFingerprintIndex
 	labelNameToLabelValues         *index.LabelNameLabelValuesIndex
+	fingerprintToExemplars         *index.ExemplarIndex
 
 	indexingQueue   chan indexingOp
 	indexingStopped chan struct{}
@@ -105,9 +139,58 @@ type persistence struct {
 	indexingBatchLatency  prometheus.Summary
 	checkpointDuration    prometheus.Gauge
 
+	cleanupStage2SeriesScanned   prometheus.Counter
+	cleanupStage2IndexesRepaired prometheus.Counter
+
 	dirtyMtx sync.Mutex // Protects dirty and becameDirty.
 
 	dirty, becameDirty bool
+
+	// wal records appended samples ahead of them being reflected in a
+	// series' chunk file or the heads checkpoint, so a crash between
+	// checkpoints only loses whatever the WAL itself failed to fsync.
+	wal *wal
+
+	// cleanupCtx is cancelled by close() so that a cleanUpStage2 scan
+	// running concurrently with shutdown stops promptly instead of
+	// holding up process exit.
+	cleanupCtx    context.Context
+	cleanupCancel context.CancelFunc
+
+	// snapshotMtx serializes Snapshot against dropChunks' rewrite of a
+	// series (drop the whole thing via chunkStore, then write back
+	// whatever tail is kept). Appends performed by persistChunk are safe
+	// to observe mid-flight (chunk files are append-only, so they only
+	// ever add to what Snapshot's copy sees), but a rewrite replacing the
+	// file while Snapshot copies it would leave the copy made from a file
+	// that either shrank unexpectedly or, briefly, didn't exist at all.
+	snapshotMtx sync.RWMutex
+
+	// tombstones records deletions requested via DeleteSeries ahead of
+	// compactTombstones reclaiming their space; see tombstone.go.
+	tombstones *tombstoneStore
+
+	tombstonesCreated prometheus.Counter
+	compactedSeries   prometheus.Counter
+
+	// fpMapper resolves fast-fingerprint collisions; see mapper.go.
+	fpMapper *fpMapper
+
+	// metricFamilyMetadata records the HELP/TYPE metadata AppendMetricFamilies
+	// persists per fingerprint; see ingest.go.
+	metricFamilyMetadata *index.MetricFamilyMetadataIndex
+
+	// sampleOrderMtx protects lastSampleTimestamp.
+	sampleOrderMtx sync.Mutex
+	// lastSampleTimestamp is the timestamp appendFamily last accepted for a
+	// given fingerprint, the high-water mark sampleOrderHighWaterMark and
+	// commitSampleOrder check and advance, rejecting any
+	// non-strictly-increasing sample. It is an in-memory cursor
+	// only, not persisted: this tree has no memorySeries head chunk to
+	// recover a series' true last timestamp from on restart, so ordering
+	// is enforced against whatever this process has itself seen since it
+	// started, not a series' full on-disk history.
+	lastSampleTimestamp map[clientmodel.Fingerprint]clientmodel.Timestamp
 }
 
 // newPersistence returns a newly allocated persistence backed by local disk storage, ready to use.
@@ -132,15 +215,41 @@ func newPersistence(basePath string, chunkLen int, dirty bool) (*persistence, er
 	if err != nil {
 		return nil, err
 	}
+	fingerprintToExemplars, err := index.NewExemplarIndex(basePath)
+	if err != nil {
+		return nil, err
+	}
+	w, err := newWAL(basePath)
+	if err != nil {
+		return nil, err
+	}
+	tombstones, err := newTombstoneStore(basePath)
+	if err != nil {
+		return nil, err
+	}
+	metricFamilyMetadata, err := index.NewMetricFamilyMetadataIndex(basePath)
+	if err != nil {
+		return nil, err
+	}
+	chunkStore, err := newChunkStoreForConfiguredEngine(basePath)
+	if err != nil {
+		return nil, err
+	}
 
 	p := &persistence{
-		basePath: basePath,
-		chunkLen: chunkLen,
+		basePath:   basePath,
+		chunkLen:   chunkLen,
+		chunkStore: chunkStore,
 
 		archivedFingerprintToMetrics:   archivedFingerprintToMetrics,
 		archivedFingerprintToTimeRange: archivedFingerprintToTimeRange,
 		labelPairToFingerprints:        labelPairToFingerprints,
 		labelNameToLabelValues:         labelNameToLabelValues,
+		fingerprintToExemplars:         fingerprintToExemplars,
+		wal:                            w,
+		tombstones:                     tombstones,
+		metricFamilyMetadata:           metricFamilyMetadata,
+		lastSampleTimestamp:            make(map[clientmodel.Fingerprint]clientmodel.Timestamp),
 
 		indexingQueue:   make(chan indexingOp, indexingQueueCapacity),
 		indexingStopped: make(chan struct{}),
@@ -183,9 +292,40 @@ func newPersistence(basePath string, chunkLen int, dirty bool) (*persistence, er
 			Name:      "checkpoint_duration_milliseconds",
 			Help:      "The duration (in milliseconds) it took to checkpoint in-memory metrics and head chunks.",
 		}),
+		cleanupStage2SeriesScanned: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "cleanup_stage2_series_scanned",
+			Help:      "The number of series files scanned so far by clean-up stage 2.",
+		}),
+		cleanupStage2IndexesRepaired: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "cleanup_stage2_indexes_repaired",
+			Help:      "The number of index entries repaired so far by clean-up stage 2.",
+		}),
+		tombstonesCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "tombstones_created_total",
+			Help:      "The number of tombstones created so far by DeleteSeries.",
+		}),
+		compactedSeries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "tombstone_compactions_total",
+			Help:      "The number of series files rewritten so far to reclaim tombstoned chunks.",
+		}),
 
 		dirty: dirty,
 	}
+	p.cleanupCtx, p.cleanupCancel = context.WithCancel(context.Background())
+
+	fpMapper, err := newFPMapper(basePath, p.fpInUseOnDisk)
+	if err != nil {
+		return nil, err
+	}
+	p.fpMapper = fpMapper
 
 	if dirtyFile, err := os.OpenFile(p.dirtyFileName(), os.O_CREATE|os.O_EXCL, 0666); err == nil {
 		dirtyFile.Close()
@@ -196,6 +336,7 @@ func newPersistence(basePath string, chunkLen int, dirty bool) (*persistence, er
 	}
 
 	go p.processIndexingQueue()
+	go p.runTombstoneCompactor(*tombstoneCompactionIntervalFlag)
 	return p, nil
 }
 
@@ -206,6 +347,10 @@ func (p *persistence) Describe(ch chan<- *prometheus.Desc) {
 	p.indexingBatchSizes.Describe(ch)
 	p.indexingBatchLatency.Describe(ch)
 	ch <- p.checkpointDuration.Desc()
+	ch <- p.cleanupStage2SeriesScanned.Desc()
+	ch <- p.cleanupStage2IndexesRepaired.Desc()
+	ch <- p.tombstonesCreated.Desc()
+	ch <- p.compactedSeries.Desc()
 }
 
 // Collect implements prometheus.Collector.
@@ -217,6 +362,10 @@ func (p *persistence) Collect(ch chan<- prometheus.Metric) {
 	p.indexingBatchSizes.Collect(ch)
 	p.indexingBatchLatency.Collect(ch)
 	ch <- p.checkpointDuration
+	ch <- p.cleanupStage2SeriesScanned
+	ch <- p.cleanupStage2IndexesRepaired
+	ch <- p.tombstonesCreated
+	ch <- p.compactedSeries
 }
 
 // dirtyFileName returns the name of the (empty) file used to mark the
@@ -329,19 +478,34 @@ func (p *persistence) sanitizeSeries(dirname string, fi os.FileInfo, fingerprint
 	}
 	fp.LoadFromString(path.Base(dirname) + fi.Name()) // TODO: Panics if fi.Name() doesn't parse as hex.
 
-	bytesToTrim := fi.Size() % int64(p.chunkLen+chunkHeaderLen)
-	chunksInFile := int(fi.Size())/p.chunkLen + chunkHeaderLen
+	// Chunk records no longer have a fixed stride once bodies can be
+	// compressed, so we can't find the valid prefix with a simple modulo
+	// against fi.Size(); walk the headers instead and trim whatever
+	// trailing bytes don't form a complete record.
+	f, err := os.OpenFile(filename, os.O_RDWR, 0640)
+	if err != nil {
+		glog.Errorf("Could not open file %s: %s", filename, err)
+		return fp, true
+	}
+	defer f.Close()
+	entries, err := walkChunkFile(f, p.chunkLen)
+	if err != nil {
+		glog.Errorf("Could not walk file %s: %s", filename, err)
+		return fp, true
+	}
+	chunksInFile := len(entries)
+	validSize := int64(0)
+	if chunksInFile > 0 {
+		last := entries[chunksInFile-1]
+		validSize = last.offset + last.length
+	}
+	bytesToTrim := fi.Size() - validSize
 	if bytesToTrim != 0 {
 		glog.Warningf(
 			"Truncating file %s to exactly %d chunks, trimming %d extraneous bytes.",
 			filename, chunksInFile, bytesToTrim,
 		)
-		f, err := os.OpenFile(filename, os.O_WRONLY, 0640)
-		if err != nil {
-			glog.Errorf("Could not open file %s: %s", filename, err)
-			return fp, true
-		}
-		if err := f.Truncate(fi.Size() - bytesToTrim); err != nil {
+		if err := f.Truncate(validSize); err != nil {
 			glog.Errorf("Failed to truncate file %s: %s", filename, err)
 			return fp, true
 		}
@@ -386,15 +550,181 @@ func (p *persistence) sanitizeSeries(dirname string, fi os.FileInfo, fingerprint
 
 // cleanUpStage2 completes the clean-up of a dirty persistence. It is run as
 // a goroutine in parallel to normal operations (but queries might yield
-// incomplete results). If it is successful, it will unset the dirty flag of
-// the persistence.
+// incomplete results). It re-derives the (fingerprint, firstTime, lastTime)
+// of every series directly from its chunk file on disk and reconciles that
+// against the archived-series index and the label indexes, repairing
+// whatever is missing or stale through the same indexing queue normal
+// ingestion uses. The dirty flag is only cleared if the whole pass
+// completes without error; a cancelled scan (persistence closing) or an
+// I/O error leaves it set so the next start-up retries.
 func (p *persistence) cleanUpStage2(fingerprintToSeries *seriesMap) {
 	glog.Warning("Starting clean-up stage 2. Prometheus is able to serve now, but queries may yield incomplete results.")
-	// TODO: Implement.
+
+	liveMetrics := map[clientmodel.Fingerprint]clientmodel.Metric{}
+	for m := range fingerprintToSeries.iter() {
+		liveMetrics[m.fp] = m.series.metric
+	}
+
+	if err := p.reconcileIndexes(liveMetrics); err != nil {
+		glog.Errorf("Clean-up stage 2 did not complete, persistence remains dirty: %s", err)
+		return
+	}
+
 	p.setDirty(false)
 	glog.Warning("Clean-up stage 2 completed. Prometheus is fully operational.")
 }
 
+// reconcileIndexes walks every series file under basePath/xx/ and repairs
+// the archived-series index and the label indexes for any fingerprint
+// found to disagree with what's actually on disk. liveMetrics are
+// fingerprints with an in-memory series; those are never archived and are
+// assumed to already be correctly label-indexed by normal ingestion, but
+// are still checked since that's the whole point of a dirty-persistence
+// scan. A series file that cannot be read or reconciled is logged and the
+// scan goes on; the last such error is returned once the scan ends.
+func (p *persistence) reconcileIndexes(liveMetrics map[clientmodel.Fingerprint]clientmodel.Metric) error {
+	var seriesErr error
+	for i := 0; i < 256; i++ {
+		select {
+		case <-p.cleanupCtx.Done():
+			return p.cleanupCtx.Err()
+		default:
+		}
+		dirname := path.Join(p.basePath, fmt.Sprintf("%02x", i))
+		dir, err := os.Open(dirname)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fis, err := dir.Readdir(-1)
+		dir.Close()
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			select {
+			case <-p.cleanupCtx.Done():
+				return p.cleanupCtx.Err()
+			default:
+			}
+			if len(fi.Name()) != 17 || !strings.HasSuffix(fi.Name(), seriesFileSuffix) {
+				continue
+			}
+			var fp clientmodel.Fingerprint
+			fp.LoadFromString(path.Base(dirname) + fi.Name())
+			p.cleanupStage2SeriesScanned.Inc()
+
+			first, last, err := p.seriesTimeRangeOnDisk(fp)
+			if err != nil {
+				glog.Warningf("Could not determine on-disk time range for fingerprint %v: %s", fp, err)
+				seriesErr = err
+				continue
+			}
+			if err := p.reconcileSeries(fp, first, last, liveMetrics); err != nil {
+				glog.Warningf("Could not reconcile indexes for fingerprint %v: %s", fp, err)
+				seriesErr = err
+			}
+		}
+	}
+	return seriesErr
+}
+
+// seriesTimeRangeOnDisk derives a series' overall first and last sample
+// time directly from its chunk file headers, independent of any index or
+// in-memory state.
+func (p *persistence) seriesTimeRangeOnDisk(fp clientmodel.Fingerprint) (first, last clientmodel.Timestamp, err error) {
+	f, err := p.openChunkFileForReading(fp)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	entries, err := walkChunkFile(f, p.chunkLen)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(entries) == 0 {
+		return 0, 0, fmt.Errorf("series file for %v has no complete chunks", fp)
+	}
+
+	timesBuf := make([]byte, 16)
+	for i, entry := range entries {
+		if _, err := f.Seek(entry.offset+chunkHeaderFirstTimeOffset, os.SEEK_SET); err != nil {
+			return 0, 0, err
+		}
+		if _, err := io.ReadFull(f, timesBuf); err != nil {
+			return 0, 0, err
+		}
+		chunkFirst := clientmodel.Timestamp(binary.LittleEndian.Uint64(timesBuf))
+		chunkLast := clientmodel.Timestamp(binary.LittleEndian.Uint64(timesBuf[8:]))
+		if i == 0 || chunkFirst.Before(first) {
+			first = chunkFirst
+		}
+		if i == 0 || last.Before(chunkLast) {
+			last = chunkLast
+		}
+	}
+	return first, last, nil
+}
+
+// reconcileSeries repairs the archived-series index entry and label
+// indexes for a single on-disk series, if they don't already agree with
+// (first, last) and the series' own label set. It reports how many index
+// entries it had to repair via cleanupStage2IndexesRepaired.
+func (p *persistence) reconcileSeries(
+	fp clientmodel.Fingerprint, first, last clientmodel.Timestamp,
+	liveMetrics map[clientmodel.Fingerprint]clientmodel.Metric,
+) error {
+	met, isLive := liveMetrics[fp]
+	if !isLive {
+		archived, err := p.getArchivedMetric(fp)
+		if err != nil {
+			return err
+		}
+		if archived == nil {
+			// Neither live nor archived: we have no metric to index
+			// this series file under, so there is nothing to repair.
+			return nil
+		}
+		met = archived
+
+		hasRange, existingFirst, existingLast, err := p.hasArchivedMetric(fp)
+		if err != nil {
+			return err
+		}
+		if !hasRange || existingFirst != first || existingLast != last {
+			if err := p.archiveMetric(fp, met, first, last); err != nil {
+				return err
+			}
+			p.cleanupStage2IndexesRepaired.Inc()
+		}
+	}
+
+	for ln, lv := range met {
+		fps, err := p.getFingerprintsForLabelPair(metric.LabelPair{Name: ln, Value: lv})
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, other := range fps {
+			if other == fp {
+				found = true
+				break
+			}
+		}
+		if !found {
+			// indexMetric repairs every label pair and label value for
+			// met in one go, so one missing pair is enough to trigger it.
+			p.indexMetric(fp, met)
+			p.cleanupStage2IndexesRepaired.Inc()
+			break
+		}
+	}
+	return nil
+}
+
 // getFingerprintsForLabelPair returns the fingerprints for the given label
 // pair. This method is goroutine-safe but take into account that metrics queued
 // for indexing with IndexMetric might not yet made it into the index. (Same
@@ -419,6 +749,63 @@ func (p *persistence) getLabelValuesForLabelName(ln clientmodel.LabelName) (clie
 	return lvs, nil
 }
 
+// addExemplar records an exemplar for the given fingerprint, evicting the
+// oldest stored exemplar for that series if necessary. This method is
+// goroutine-safe.
+func (p *persistence) addExemplar(fp clientmodel.Fingerprint, e index.Exemplar) error {
+	return p.fingerprintToExemplars.Add(fp, e)
+}
+
+// getExemplars returns the most recently recorded exemplars for the given
+// fingerprint, oldest first. This method is goroutine-safe.
+func (p *persistence) getExemplars(fp clientmodel.Fingerprint) ([]index.Exemplar, error) {
+	exemplars, _, err := p.fingerprintToExemplars.Lookup(fp)
+	return exemplars, err
+}
+
+// logSample records an appended sample in the write-ahead log, ahead of it
+// being reflected in the series' in-memory head chunk becoming part of a
+// checkpoint or a persisted chunk file. This method is goroutine-safe.
+func (p *persistence) logSample(fp clientmodel.Fingerprint, ts clientmodel.Timestamp, v metric.SampleValue) error {
+	return p.wal.LogSample(fp, ts, v)
+}
+
+// logHeadChunkPersisted records in the write-ahead log that the head chunk
+// active for fp at the time of the call has been persisted to the chunk
+// file, so that WAL replay after a crash knows to start a fresh head chunk
+// for any walOpSample record that follows for the same fingerprint rather
+// than appending to the (now also on-disk) one. This method is
+// goroutine-safe.
+func (p *persistence) logHeadChunkPersisted(fp clientmodel.Fingerprint) error {
+	return p.wal.LogHeadChunkPersisted(fp)
+}
+
+// sampleOrderHighWaterMark returns the last timestamp appendFamily has
+// accepted for fp, if any. It does not mutate any state; appendFamily uses
+// it to validate a whole family's ordering before committing any of it, via
+// commitSampleOrder. This method is goroutine-safe.
+func (p *persistence) sampleOrderHighWaterMark(fp clientmodel.Fingerprint) (clientmodel.Timestamp, bool) {
+	p.sampleOrderMtx.Lock()
+	defer p.sampleOrderMtx.Unlock()
+
+	ts, ok := p.lastSampleTimestamp[fp]
+	return ts, ok
+}
+
+// commitSampleOrder records marks as the new high-water mark for each
+// fingerprint it contains, to be called only once every sample in a family
+// has already been validated against sampleOrderHighWaterMark (and against
+// each other), so that a rejected family never advances any fingerprint's
+// high-water mark. This method is goroutine-safe.
+func (p *persistence) commitSampleOrder(marks map[clientmodel.Fingerprint]clientmodel.Timestamp) {
+	p.sampleOrderMtx.Lock()
+	defer p.sampleOrderMtx.Unlock()
+
+	for fp, ts := range marks {
+		p.lastSampleTimestamp[fp] = ts
+	}
+}
+
 // persistChunk persists a single chunk of a series. It is the caller's
 // responsibility to not modify chunk concurrently and to not persist or drop
 // anything for the same fingerprint concurrently. It returns the (zero-based)
@@ -426,39 +813,72 @@ func (p *persistence) getLabelValuesForLabelName(ln clientmodel.LabelName) (clie
 // returned index is -1 (to avoid the misconception that the chunk was written
 // at position 0).
 func (p *persistence) persistChunk(fp clientmodel.Fingerprint, c chunk) (int, error) {
-	// 1. Open chunk file.
-	f, err := p.openChunkFileForWriting(fp)
-	if err != nil {
+	// 1. Determine the index the chunk will land at by counting the
+	// records already in the file. Chunk records are no longer a fixed
+	// size once compression is in play, so this requires a header-walk
+	// rather than offset arithmetic.
+	index := 0
+	if rf, err := p.openChunkFileForReading(fp); err == nil {
+		entries, err := walkChunkFile(rf, p.chunkLen)
+		rf.Close()
+		if err != nil {
+			return -1, err
+		}
+		index = len(entries)
+	} else if !os.IsNotExist(err) {
 		return -1, err
 	}
-	defer f.Close()
-
-	b := bufio.NewWriterSize(f, chunkHeaderLen+p.chunkLen)
 
-	// 2. Write the header (chunk type and first/last times).
-	err = writeChunkHeader(b, c)
+	// 2. Marshal and, if configured, compress the chunk body.
+	var body bytes.Buffer
+	if err := c.marshal(&body); err != nil {
+		return -1, err
+	}
+	compression := configuredChunkCompression()
+	compressed, err := compressChunkBody(body.Bytes(), compression)
 	if err != nil {
 		return -1, err
 	}
 
-	// 3. Write chunk into file.
-	err = c.marshal(b)
+	// 3. Open chunk file and append the header, optional length field,
+	// and (possibly compressed) body.
+	f, err := p.openChunkFileForWriting(fp)
 	if err != nil {
 		return -1, err
 	}
+	defer f.Close()
 
-	// 4. Determine index within the file.
-	b.Flush()
-	offset, err := f.Seek(0, os.SEEK_CUR)
-	if err != nil {
+	b := bufio.NewWriterSize(f, chunkHeaderLen+chunkHeaderLenFieldLen+len(compressed))
+	if err := writeChunkHeader(b, c, compression); err != nil {
 		return -1, err
 	}
-	index, err := p.chunkIndexForOffset(offset)
-	if err != nil {
+	if compression != chunkCompressionNone {
+		lenBuf := make([]byte, chunkHeaderLenFieldLen)
+		binary.LittleEndian.PutUint32(lenBuf, uint32(len(compressed)))
+		if _, err := b.Write(lenBuf); err != nil {
+			return -1, err
+		}
+	}
+	if _, err := b.Write(compressed); err != nil {
 		return -1, err
 	}
+	if err := b.Flush(); err != nil {
+		return -1, err
+	}
+
+	return index, nil
+}
 
-	return index - 1, err
+// chunkReadBufPool pools the buffers loadChunks uses to satisfy a single
+// contiguous read. Reusing them across calls avoids the per-chunk
+// allocation churn a busy query engine would otherwise produce; each
+// buffer is grown (and returned to the pool at its new size) as needed by
+// whatever range it was asked to hold.
+var chunkReadBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, chunkHeaderLen+chunkHeaderLenFieldLen)
+		return &buf
+	},
 }
 
 // loadChunks loads a group of chunks of a timeseries by their index. The chunk
@@ -466,46 +886,93 @@ func (p *persistence) persistChunk(fp clientmodel.Fingerprint, c chunk) (int, er
 // incrementally larger indexes. The indexOffset denotes the offset to be added to
 // each index in indexes. It is the caller's responsibility to not persist or
 // drop anything for the same fingerprint concurrently.
+//
+// Requested indexes are sorted and coalesced into contiguous on-disk ranges
+// first, so that a batch of adjacent indexes (the common case for range
+// queries) costs one seek-and-read per range rather than one per index.
 func (p *persistence) loadChunks(fp clientmodel.Fingerprint, indexes []int, indexOffset int) ([]chunk, error) {
-	// TODO: we need to verify at some point that file length is a multiple of
-	// the chunk size. When is the best time to do this, and where to remember
-	// it? Right now, we only do it when loading chunkDescs.
 	f, err := p.openChunkFileForReading(fp)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	chunks := make([]chunk, 0, len(indexes))
-	typeBuf := make([]byte, 1)
-	for _, idx := range indexes {
-		_, err := f.Seek(p.offsetForChunkIndex(idx+indexOffset), os.SEEK_SET)
-		if err != nil {
-			return nil, err
+	entries, err := walkChunkFile(f, p.chunkLen)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := append([]int(nil), indexes...)
+	sort.Ints(sorted)
+
+	byIndex := make(map[int]chunk, len(indexes))
+	for start := 0; start < len(sorted); {
+		end := start
+		for end+1 < len(sorted) && sorted[end+1] == sorted[end]+1 {
+			end++
 		}
+		runStart := sorted[start] + indexOffset
+		runEnd := sorted[end] + indexOffset // Inclusive.
 
-		n, err := f.Read(typeBuf)
-		if err != nil {
+		first := entries[runStart]
+		last := entries[runEnd]
+		rangeLen := (last.offset + last.length) - first.offset
+
+		bufPtr := chunkReadBufPool.Get().(*[]byte)
+		buf := *bufPtr
+		if int64(cap(buf)) < rangeLen {
+			buf = make([]byte, rangeLen)
+		} else {
+			buf = buf[:rangeLen]
+		}
+		if _, err := f.Seek(first.offset, os.SEEK_SET); err != nil {
 			return nil, err
 		}
-		if n != 1 {
-			panic("read returned != 1 bytes")
+		if _, err := io.ReadFull(f, buf); err != nil {
+			return nil, err
 		}
 
-		_, err = f.Seek(chunkHeaderLen-1, os.SEEK_CUR)
-		if err != nil {
-			return nil, err
+		for i := runStart; i <= runEnd; i++ {
+			entry := entries[i]
+			rec := buf[entry.offset-first.offset : entry.offset-first.offset+entry.length]
+			encoding, compression := unpackTypeByte(rec[chunkHeaderTypeOffset])
+			body := rec[chunkHeaderLen:]
+			if compression != chunkCompressionNone {
+				bodyLen := binary.LittleEndian.Uint32(body[:chunkHeaderLenFieldLen])
+				compressed := body[chunkHeaderLenFieldLen : chunkHeaderLenFieldLen+int(bodyLen)]
+				raw, err := decompressChunkBody(compressed, compression)
+				if err != nil {
+					return nil, err
+				}
+				body = raw
+			}
+			c := chunkForType(encoding)
+			if err := c.unmarshal(bytes.NewReader(body)); err != nil {
+				return nil, err
+			}
+			byIndex[i-indexOffset] = c
 		}
-		chunk := chunkForType(typeBuf[0])
-		chunk.unmarshal(f)
-		chunks = append(chunks, chunk)
+
+		*bufPtr = buf
+		chunkReadBufPool.Put(bufPtr)
+		start = end + 1
+	}
+
+	chunks := make([]chunk, len(indexes))
+	for i, idx := range indexes {
+		chunks[i] = byIndex[idx]
 	}
 	return chunks, nil
 }
 
-// loadChunkDescs loads chunkDescs for a series up until a given time.  It is
-// the caller's responsibility to not persist or drop anything for the same
-// fingerprint concurrently.
+// loadChunkDescs loads chunkDescs for a series up until a given time. A
+// chunk that DeleteSeries has tombstoned in its entirety is left out of the
+// result, the same as if it had already been physically dropped by
+// compactTombstones; a chunk only partially covered by a tombstone is
+// still returned whole, since nothing here decodes and re-encodes a
+// chunk's body to clip it to its surviving samples. It is the caller's
+// responsibility to not persist or drop anything for the same fingerprint
+// concurrently.
 func (p *persistence) loadChunkDescs(fp clientmodel.Fingerprint, beforeTime clientmodel.Timestamp) ([]*chunkDesc, error) {
 	f, err := p.openChunkFileForReading(fp)
 	if os.IsNotExist(err) {
@@ -516,27 +983,40 @@ func (p *persistence) loadChunkDescs(fp clientmodel.Fingerprint, beforeTime clie
 	}
 	defer f.Close()
 
-	fi, err := f.Stat()
+	entries, err := walkChunkFile(f, p.chunkLen)
 	if err != nil {
 		return nil, err
 	}
-	totalChunkLen := chunkHeaderLen + p.chunkLen
-	if fi.Size()%int64(totalChunkLen) != 0 {
-		// TODO: record number of encountered corrupt series files in a metric?
-
-		// Truncate the file size to the nearest multiple of chunkLen.
-		truncateTo := fi.Size() - fi.Size()%int64(totalChunkLen)
-		glog.Infof("Bad series file size for %s: %d bytes (no multiple of %d). Truncating to %d bytes.", fp, fi.Size(), totalChunkLen, truncateTo)
-		// TODO: this doesn't work, as this is a read-only file handle.
-		if err := f.Truncate(truncateTo); err != nil {
-			return nil, err
+	// walkChunkFile has already advanced f to the offset right after the
+	// last complete record; Seek(0, SeekEnd) from there is how a
+	// chunkFileReader reports a file's size, since not every ChunkStore
+	// backs this with a concrete *os.File that has Stat.
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		lastEntry := entries[len(entries)-1]
+		if complete := lastEntry.offset + lastEntry.length; complete != size {
+			// TODO: record number of encountered corrupt series files in a metric?
+			glog.Infof("Bad series file size for %s: %d bytes (expected %d after %d complete chunk records). Truncating.", fp, size, complete, len(entries))
+			if t, ok := f.(interface{ Truncate(int64) error }); ok {
+				// TODO: this doesn't work, as this is a read-only file handle.
+				if err := t.Truncate(complete); err != nil {
+					return nil, err
+				}
+			} else {
+				glog.Warningf("Chunk store for %s does not support truncation; leaving corrupt trailing bytes in place.", fp)
+			}
 		}
 	}
 
-	numChunks := int(fi.Size()) / totalChunkLen
+	tombstoned := p.tombstones.rangesFor(fp)
+
+	numChunks := len(entries)
 	cds := make([]*chunkDesc, 0, numChunks)
-	for i := 0; i < numChunks; i++ {
-		_, err := f.Seek(p.offsetForChunkIndex(i)+chunkHeaderFirstTimeOffset, os.SEEK_SET)
+	for _, entry := range entries {
+		_, err := f.Seek(entry.offset+chunkHeaderFirstTimeOffset, os.SEEK_SET)
 		if err != nil {
 			return nil, err
 		}
@@ -554,6 +1034,9 @@ func (p *persistence) loadChunkDescs(fp clientmodel.Fingerprint, beforeTime clie
 			// From here on, we have chunkDescs in memory already.
 			break
 		}
+		if chunkEntirelyTombstoned(tombstoned, cd.chunkFirstTime, cd.chunkLastTime) {
+			continue
+		}
 		cds = append(cds, cd)
 	}
 	chunkDescOps.WithLabelValues(load).Add(float64(len(cds)))
@@ -581,7 +1064,18 @@ func (p *persistence) checkpointSeriesMapAndHeads(fingerprintToSeries *seriesMap
 		if err != nil {
 			return
 		}
+		if rotErr := p.rotateHeadsGenerations(); rotErr != nil {
+			glog.Error("Error rotating heads file generations: ", rotErr)
+		}
 		err = os.Rename(p.headsTempFileName(), p.headsFileName())
+		if err == nil {
+			// Everything the WAL was protecting is now durably
+			// reflected in the checkpoint; every segment but the
+			// currently active one can go.
+			if walErr := p.wal.Truncate(p.wal.nextSegment - 2); walErr != nil {
+				glog.Error("Error truncating WAL after checkpoint: ", walErr)
+			}
+		}
 		duration := time.Since(begin)
 		p.checkpointDuration.Set(float64(duration) / float64(time.Millisecond))
 		glog.Infof("Done checkpointing in-memory metrics and head chunks in %v.", duration)
@@ -611,6 +1105,17 @@ func (p *persistence) checkpointSeriesMapAndHeads(fingerprintToSeries *seriesMap
 		}
 	}()
 
+	// Each series is framed as length-prefixed record bytes followed by a
+	// CRC32C of those bytes, so that a single damaged record can be
+	// detected (and the whole file rejected) without depending on every
+	// field downstream still being in sync. footerHash accumulates over
+	// every frame written so that loadSeriesMapAndHeads can verify the
+	// file as a whole against the trailing footer before trusting any of
+	// its contents.
+	footerHash := crc32.New(crc32cTable)
+	lenBuf := make([]byte, headsRecordLenFieldLen)
+	crcBuf := make([]byte, headsRecordCRCLen)
+
 	var realNumberOfSeries uint64
 	for m := range iter {
 		func() { // Wrapped in function to use defer for unlocking the fp.
@@ -622,14 +1127,16 @@ func (p *persistence) checkpointSeriesMapAndHeads(fingerprintToSeries *seriesMap
 				return
 			}
 			realNumberOfSeries++
+
+			rec := bytes.NewBuffer(make([]byte, 0, 4096))
 			var seriesFlags byte
 			if m.series.headChunkPersisted {
 				seriesFlags |= flagHeadChunkPersisted
 			}
-			if err = w.WriteByte(seriesFlags); err != nil {
+			if err = rec.WriteByte(seriesFlags); err != nil {
 				return
 			}
-			if err = codable.EncodeUint64(w, uint64(m.fp)); err != nil {
+			if err = codable.EncodeUint64(rec, uint64(m.fp)); err != nil {
 				return
 			}
 			var buf []byte
@@ -637,42 +1144,65 @@ func (p *persistence) checkpointSeriesMapAndHeads(fingerprintToSeries *seriesMap
 			if err != nil {
 				return
 			}
-			w.Write(buf)
-			if _, err = codable.EncodeVarint(w, int64(m.series.chunkDescsOffset)); err != nil {
+			rec.Write(buf)
+			if _, err = codable.EncodeVarint(rec, int64(m.series.chunkDescsOffset)); err != nil {
 				return
 			}
-			if _, err = codable.EncodeVarint(w, int64(len(m.series.chunkDescs))); err != nil {
+			if _, err = codable.EncodeVarint(rec, int64(len(m.series.chunkDescs))); err != nil {
 				return
 			}
 			for i, chunkDesc := range m.series.chunkDescs {
 				if m.series.headChunkPersisted || i < len(m.series.chunkDescs)-1 {
-					if _, err = codable.EncodeVarint(w, int64(chunkDesc.firstTime())); err != nil {
+					if _, err = codable.EncodeVarint(rec, int64(chunkDesc.firstTime())); err != nil {
 						return
 					}
-					if _, err = codable.EncodeVarint(w, int64(chunkDesc.lastTime())); err != nil {
+					if _, err = codable.EncodeVarint(rec, int64(chunkDesc.lastTime())); err != nil {
 						return
 					}
 				} else {
 					// This is the non-persisted head chunk. Fully marshal it.
-					if err = w.WriteByte(chunkType(chunkDesc.chunk)); err != nil {
+					if err = rec.WriteByte(chunkType(chunkDesc.chunk)); err != nil {
 						return
 					}
-					if err = chunkDesc.chunk.marshal(w); err != nil {
+					if err = chunkDesc.chunk.marshal(rec); err != nil {
 						return
 					}
 				}
 			}
+
+			binary.LittleEndian.PutUint32(lenBuf, uint32(rec.Len()))
+			crc := crc32.Checksum(rec.Bytes(), crc32cTable)
+			binary.LittleEndian.PutUint32(crcBuf, crc)
+
+			if _, err = w.Write(lenBuf); err != nil {
+				return
+			}
+			if _, err = w.Write(rec.Bytes()); err != nil {
+				return
+			}
+			if _, err = w.Write(crcBuf); err != nil {
+				return
+			}
+			footerHash.Write(lenBuf)
+			footerHash.Write(rec.Bytes())
+			footerHash.Write(crcBuf)
 		}()
 		if err != nil {
 			return
 		}
 	}
+	footerBuf := make([]byte, headsFooterLen)
+	binary.LittleEndian.PutUint64(footerBuf[0:8], realNumberOfSeries)
+	binary.LittleEndian.PutUint32(footerBuf[8:12], footerHash.Sum32())
+	if _, err = w.Write(footerBuf); err != nil {
+		return
+	}
 	if err = w.Flush(); err != nil {
 		return
 	}
 	if realNumberOfSeries != numberOfSeriesInHeader {
-		// The number of series has changed in the meantime.
-		// Rewrite it in the header.
+		// The number of series changed while we were iterating; correct
+		// the header field we reserved room for at the top of the file.
 		if _, err = f.Seek(int64(numberOfSeriesOffset), os.SEEK_SET); err != nil {
 			return
 		}
@@ -684,14 +1214,50 @@ func (p *persistence) checkpointSeriesMapAndHeads(fingerprintToSeries *seriesMap
 }
 
 // loadSeriesMapAndHeads loads the fingerprint to memory-series mapping and all
-// open (non-full) head chunks. If recoverable corruption is detected, or if the
-// dirty flag was set from the beginning, stage 1 of the clean-up is run. The
-// method will return once it is done. An unrecoverable error is returned. Call
-// this method during start-up while nothing else is running in storage
-// land. This method is utterly goroutine-unsafe.
+// open (non-full) head chunks, then replays the WAL on top of it. A WAL
+// record for a fingerprint the heads file didn't load is un-archived via
+// unarchiveMetric if an archive entry exists for it, so samples appended to a
+// since-archived series just before a crash are not lost; a fingerprint with
+// no archive entry either has no metric recoverable anywhere in this method
+// and is dropped, which also sets the dirty flag. If recoverable corruption
+// is detected, or if the dirty flag was set from the beginning, stage 1 of
+// the clean-up is run. The method will return once it is done. An
+// unrecoverable error is returned. Call this method during start-up while
+// nothing else is running in storage land. This method is utterly
+// goroutine-unsafe.
 func (p *persistence) loadSeriesMapAndHeads() (sm *seriesMap, err error) {
+	var fingerprintToSeries map[clientmodel.Fingerprint]*memorySeries
 	var chunksTotal, chunkDescsTotal int64
-	fingerprintToSeries := make(map[clientmodel.Fingerprint]*memorySeries)
+
+	for gen := 0; gen < headsNumGenerations; gen++ {
+		filename := p.headsGenerationFileName(gen)
+		m, ct, cdt, loadErr := p.loadHeadsFile(filename)
+		if loadErr == nil {
+			fingerprintToSeries, chunksTotal, chunkDescsTotal = m, ct, cdt
+			break
+		}
+		if os.IsNotExist(loadErr) {
+			if gen == 0 {
+				// Generation 0 not existing usually just means there has
+				// never been a checkpoint. But it can also mean a crash
+				// landed between rotateHeadsGenerations renaming it out of
+				// the way and checkpointSeriesMapAndHeads renaming the new
+				// one into place, in which case generation 1 holds a
+				// perfectly good checkpoint one generation back. Keep
+				// trying later generations either way; only once we've run
+				// out of fallbacks is there truly nothing to load.
+				continue
+			}
+			// A later generation not existing just means we've run out of
+			// fallbacks.
+			break
+		}
+		glog.Warningf("Heads file %s failed integrity check, falling back to previous generation: %s", filename, loadErr)
+		p.dirty = true
+	}
+	if fingerprintToSeries == nil {
+		fingerprintToSeries = make(map[clientmodel.Fingerprint]*memorySeries)
+	}
 	sm = &seriesMap{m: fingerprintToSeries}
 
 	defer func() {
@@ -708,125 +1274,212 @@ func (p *persistence) loadSeriesMapAndHeads() (sm *seriesMap, err error) {
 		}
 	}()
 
-	f, err := os.Open(p.headsFileName())
-	if os.IsNotExist(err) {
-		return
+	// Replay anything appended to the WAL after the last checkpoint: those
+	// samples (and head-chunk state transitions) are durable (they were
+	// fsynced, modulo the configured fsync policy) but not yet reflected
+	// in the series loaded above.
+	if err := replayWAL(p.basePath, func(fp clientmodel.Fingerprint, ts clientmodel.Timestamp, v metric.SampleValue, op walOpType) {
+		series, ok := fingerprintToSeries[fp]
+		if !ok {
+			// fp is not among the series the heads file just loaded. It
+			// may still be a series that was archived (evicted from
+			// memory, fully persisted) as of the last checkpoint but
+			// received new samples before the crash: its metric is still
+			// known via the archive indexes, so un-archive it here rather
+			// than losing those samples. A fp with no archive entry
+			// either was never indexed anywhere durable outside the WAL
+			// itself (a series created and only ever appended to between
+			// checkpoints); there is no metric to recover it under, so
+			// its samples are necessarily lost.
+			met, err := p.getArchivedMetric(fp)
+			if err != nil {
+				glog.Warningf("Could not look up archived metric for fingerprint %v found in WAL: %s", fp, err)
+				p.dirty = true
+				return
+			}
+			if met == nil {
+				glog.Warningf("Fingerprint %v found in WAL has neither a loaded nor an archived series; discarding its samples.", fp)
+				p.dirty = true
+				return
+			}
+			if _, err := p.unarchiveMetric(fp); err != nil {
+				glog.Warningf("Could not un-archive fingerprint %v found in WAL: %s", fp, err)
+				p.dirty = true
+				return
+			}
+			series = &memorySeries{metric: met}
+			fingerprintToSeries[fp] = series
+		}
+		switch op {
+		case walOpHeadChunkPersisted:
+			// The head chunk active at WAL-write time was flushed to
+			// the chunk file; nothing to replay into memory, but any
+			// walOpSample that follows must start a new head chunk
+			// rather than appending to the one already marked
+			// persisted below.
+			series.headChunkPersisted = true
+		case walOpSample:
+			if len(series.chunkDescs) == 0 || series.headChunkPersisted {
+				series.chunkDescs = append(series.chunkDescs, newChunkDesc(newChunkForIngestion()))
+				series.headChunkPersisted = false
+			}
+			head := series.chunkDescs[len(series.chunkDescs)-1]
+			// add may return overflow chunks if head.chunk just filled up;
+			// per its own doc, those (and the possibly-reallocated head
+			// chunk itself) must become the new chunkDescs, or samples
+			// past the first overflow are silently dropped on replay.
+			newChunks := head.chunk.add(&metric.SamplePair{Timestamp: ts, Value: v})
+			head.chunk = newChunks[0]
+			for _, overflow := range newChunks[1:] {
+				series.chunkDescs = append(series.chunkDescs, newChunkDesc(overflow))
+			}
+		}
+	}); err != nil {
+		glog.Warning("Could not fully replay WAL:", err)
+		p.dirty = true
 	}
+
+	return sm, nil
+}
+
+// loadHeadsFile loads and fully integrity-checks a single heads file
+// generation: it verifies the trailing footer's record count and CRC32C
+// over all series records before trusting any of them, then verifies each
+// record's own CRC32C as it is decoded. A non-nil error (other than one
+// satisfying os.IsNotExist) means the file is unusable in whole, and the
+// caller should fall back to an older generation rather than trust a
+// partially-parsed result.
+func (p *persistence) loadHeadsFile(filename string) (map[clientmodel.Fingerprint]*memorySeries, int64, int64, error) {
+	f, err := os.Open(filename)
 	if err != nil {
-		glog.Warning("Could not open heads file:", err)
-		p.dirty = true
-		return
+		return nil, 0, 0, err
 	}
 	defer f.Close()
-	r := bufio.NewReaderSize(f, fileBufSize)
 
-	buf := make([]byte, len(headsMagicString))
-	if _, err := io.ReadFull(r, buf); err != nil {
-		glog.Warning("Could not read from heads file:", err)
-		p.dirty = true
-		return sm, nil
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, 0, 0, err
 	}
-	magic := string(buf)
-	if magic != headsMagicString {
-		glog.Warningf(
-			"unexpected magic string, want %q, got %q",
-			headsMagicString, magic,
-		)
-		p.dirty = true
-		return
+	r := bytes.NewReader(data)
+
+	magicBuf := make([]byte, len(headsMagicString))
+	if _, err := io.ReadFull(r, magicBuf); err != nil {
+		return nil, 0, 0, fmt.Errorf("could not read heads magic string: %s", err)
 	}
-	if version, err := binary.ReadVarint(r); version != headsFormatVersion || err != nil {
-		glog.Warningf("unknown heads format version, want %d", headsFormatVersion)
-		p.dirty = true
-		return sm, nil
+	if string(magicBuf) != headsMagicString {
+		return nil, 0, 0, fmt.Errorf("unexpected heads magic string %q", magicBuf)
+	}
+	version, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("could not decode heads format version: %s", err)
+	}
+	if version != headsFormatVersion {
+		return nil, 0, 0, fmt.Errorf("unknown heads format version %d, want %d", version, headsFormatVersion)
 	}
 	numSeries, err := codable.DecodeUint64(r)
 	if err != nil {
-		glog.Warning("Could not decode number of series:", err)
-		p.dirty = true
-		return sm, nil
+		return nil, 0, 0, fmt.Errorf("could not decode number of series: %s", err)
 	}
 
-	for ; numSeries > 0; numSeries-- {
-		seriesFlags, err := r.ReadByte()
+	headerLen := len(data) - r.Len()
+	if len(data) < headerLen+headsFooterLen {
+		return nil, 0, 0, fmt.Errorf("heads file too short for its footer")
+	}
+	records := data[headerLen : len(data)-headsFooterLen]
+	footer := data[len(data)-headsFooterLen:]
+	footerCount := binary.LittleEndian.Uint64(footer[0:8])
+	footerCRC := binary.LittleEndian.Uint32(footer[8:12])
+	if footerCount != numSeries {
+		return nil, 0, 0, fmt.Errorf("footer record count %d does not match header count %d", footerCount, numSeries)
+	}
+	if crc32.Checksum(records, crc32cTable) != footerCRC {
+		return nil, 0, 0, fmt.Errorf("footer CRC mismatch")
+	}
+
+	fingerprintToSeries := make(map[clientmodel.Fingerprint]*memorySeries, numSeries)
+	var chunksTotal, chunkDescsTotal int64
+
+	pos := 0
+	for i := uint64(0); i < numSeries; i++ {
+		if pos+headsRecordLenFieldLen > len(records) {
+			return nil, 0, 0, fmt.Errorf("truncated record length at record %d", i)
+		}
+		recLen := int(binary.LittleEndian.Uint32(records[pos : pos+headsRecordLenFieldLen]))
+		pos += headsRecordLenFieldLen
+		if pos+recLen+headsRecordCRCLen > len(records) {
+			return nil, 0, 0, fmt.Errorf("truncated record body at record %d", i)
+		}
+		recBytes := records[pos : pos+recLen]
+		pos += recLen
+		storedCRC := binary.LittleEndian.Uint32(records[pos : pos+headsRecordCRCLen])
+		pos += headsRecordCRCLen
+		if crc32.Checksum(recBytes, crc32cTable) != storedCRC {
+			return nil, 0, 0, fmt.Errorf("CRC mismatch in record %d", i)
+		}
+
+		rr := bytes.NewReader(recBytes)
+		seriesFlags, err := rr.ReadByte()
 		if err != nil {
-			glog.Warning("Could not read series flags:", err)
-			p.dirty = true
-			return sm, nil
+			return nil, 0, 0, fmt.Errorf("could not read series flags: %s", err)
 		}
 		headChunkPersisted := seriesFlags&flagHeadChunkPersisted != 0
-		fp, err := codable.DecodeUint64(r)
+		fp, err := codable.DecodeUint64(rr)
 		if err != nil {
-			glog.Warning("Could not decode fingerprint:", err)
-			p.dirty = true
-			return sm, nil
+			return nil, 0, 0, fmt.Errorf("could not decode fingerprint: %s", err)
 		}
-		var metric codable.Metric
-		if err := metric.UnmarshalFromReader(r); err != nil {
-			glog.Warning("Could not decode metric:", err)
-			p.dirty = true
-			return sm, nil
+		var met codable.Metric
+		if err := met.UnmarshalFromReader(rr); err != nil {
+			return nil, 0, 0, fmt.Errorf("could not decode metric: %s", err)
 		}
-		chunkDescsOffset, err := binary.ReadVarint(r)
+		chunkDescsOffset, err := binary.ReadVarint(rr)
 		if err != nil {
-			glog.Warning("Could not decode chunk descriptor offset:", err)
-			p.dirty = true
-			return sm, nil
+			return nil, 0, 0, fmt.Errorf("could not decode chunk descriptor offset: %s", err)
 		}
-		numChunkDescs, err := binary.ReadVarint(r)
+		numChunkDescs, err := binary.ReadVarint(rr)
 		if err != nil {
-			glog.Warning("Could not decode number of chunk descriptors:", err)
-			p.dirty = true
-			return sm, nil
+			return nil, 0, 0, fmt.Errorf("could not decode number of chunk descriptors: %s", err)
 		}
 		chunkDescs := make([]*chunkDesc, numChunkDescs)
 		chunkDescsTotal += numChunkDescs
 
-		for i := int64(0); i < numChunkDescs; i++ {
-			if headChunkPersisted || i < numChunkDescs-1 {
-				firstTime, err := binary.ReadVarint(r)
+		for j := int64(0); j < numChunkDescs; j++ {
+			if headChunkPersisted || j < numChunkDescs-1 {
+				firstTime, err := binary.ReadVarint(rr)
 				if err != nil {
-					glog.Warning("Could not decode first time:", err)
-					p.dirty = true
-					return sm, nil
+					return nil, 0, 0, fmt.Errorf("could not decode first time: %s", err)
 				}
-				lastTime, err := binary.ReadVarint(r)
+				lastTime, err := binary.ReadVarint(rr)
 				if err != nil {
-					glog.Warning("Could not decode last time:", err)
-					p.dirty = true
-					return sm, nil
+					return nil, 0, 0, fmt.Errorf("could not decode last time: %s", err)
 				}
-				chunkDescs[i] = &chunkDesc{
+				chunkDescs[j] = &chunkDesc{
 					chunkFirstTime: clientmodel.Timestamp(firstTime),
 					chunkLastTime:  clientmodel.Timestamp(lastTime),
 				}
 			} else {
 				// Non-persisted head chunk.
 				chunksTotal++
-				chunkType, err := r.ReadByte()
+				chunkTypeByte, err := rr.ReadByte()
 				if err != nil {
-					glog.Warning("Could not decode chunk type:", err)
-					p.dirty = true
-					return sm, nil
+					return nil, 0, 0, fmt.Errorf("could not decode chunk type: %s", err)
 				}
-				chunk := chunkForType(chunkType)
-				if err := chunk.unmarshal(r); err != nil {
-					glog.Warning("Could not decode chunk type:", err)
-					p.dirty = true
-					return sm, nil
+				chunk := chunkForType(chunkTypeByte)
+				if err := chunk.unmarshal(rr); err != nil {
+					return nil, 0, 0, fmt.Errorf("could not decode chunk: %s", err)
 				}
-				chunkDescs[i] = newChunkDesc(chunk)
+				chunkDescs[j] = newChunkDesc(chunk)
 			}
 		}
 
 		fingerprintToSeries[clientmodel.Fingerprint(fp)] = &memorySeries{
-			metric:             clientmodel.Metric(metric),
+			metric:             clientmodel.Metric(met),
 			chunkDescs:         chunkDescs,
 			chunkDescsOffset:   int(chunkDescsOffset),
 			headChunkPersisted: headChunkPersisted,
 		}
 	}
-	return sm, nil
+
+	return fingerprintToSeries, chunksTotal, chunkDescsTotal, nil
 }
 
 // dropChunks deletes all chunks from a series whose last sample time is before
@@ -834,6 +1487,9 @@ func (p *persistence) loadSeriesMapAndHeads() (sm *seriesMap, err error) {
 // the series have been deleted.  It is the caller's responsibility to make sure
 // nothing is persisted or loaded for the same fingerprint concurrently.
 func (p *persistence) dropChunks(fp clientmodel.Fingerprint, beforeTime clientmodel.Timestamp) (int, bool, error) {
+	p.snapshotMtx.RLock()
+	defer p.snapshotMtx.RUnlock()
+
 	f, err := p.openChunkFileForReading(fp)
 	if os.IsNotExist(err) {
 		return 0, true, nil
@@ -843,55 +1499,96 @@ func (p *persistence) dropChunks(fp clientmodel.Fingerprint, beforeTime clientmo
 	}
 	defer f.Close()
 
+	entries, err := walkChunkFile(f, p.chunkLen)
+	if err != nil {
+		return 0, false, err
+	}
+
 	// Find the first chunk that should be kept.
 	var i int
-	for ; ; i++ {
-		_, err := f.Seek(p.offsetForChunkIndex(i)+chunkHeaderLastTimeOffset, os.SEEK_SET)
+	lastTimeBuf := make([]byte, 8)
+	for ; i < len(entries); i++ {
+		_, err := f.Seek(entries[i].offset+chunkHeaderLastTimeOffset, os.SEEK_SET)
 		if err != nil {
 			return 0, false, err
 		}
-		lastTimeBuf := make([]byte, 8)
 		_, err = io.ReadAtLeast(f, lastTimeBuf, 8)
-		if err == io.EOF {
-			// We ran into the end of the file without finding any chunks that should
-			// be kept. Remove the whole file.
-			chunkOps.WithLabelValues(purge).Add(float64(i))
-			if err := os.Remove(f.Name()); err != nil {
-				return 0, true, err
-			}
-			return i, true, nil
-		}
 		if err != nil {
 			return 0, false, err
 		}
 		lastTime := clientmodel.Timestamp(binary.LittleEndian.Uint64(lastTimeBuf))
 		if !lastTime.Before(beforeTime) {
-			chunkOps.WithLabelValues(purge).Add(float64(i))
 			break
 		}
 	}
+	chunkOps.WithLabelValues(purge).Add(float64(i))
 
-	// We've found the first chunk that should be kept. Seek backwards to the
-	// beginning of its header and start copying everything from there into a new
-	// file.
-	_, err = f.Seek(-(chunkHeaderLastTimeOffset + 8), os.SEEK_CUR)
+	if i == len(entries) {
+		// We ran into the end of the file without finding any chunks that
+		// should be kept. Drop the whole series.
+		if err := p.chunkStore.dropChunks(fp); err != nil {
+			return 0, true, err
+		}
+		return i, true, nil
+	}
+
+	// We've found the first chunk that should be kept. Read everything from
+	// there to the end of the file into memory, drop the whole series via
+	// the chunk store, and write the kept tail back as a fresh series. This
+	// works the same way regardless of what ChunkStore backs fp, unlike the
+	// local-disk rewrite-and-rename this replaced.
+	if _, err := f.Seek(entries[i].offset, os.SEEK_SET); err != nil {
+		return 0, false, err
+	}
+	tail, err := ioutil.ReadAll(f)
 	if err != nil {
 		return 0, false, err
 	}
 
-	temp, err := os.OpenFile(p.tempFileNameForFingerprint(fp), os.O_WRONLY|os.O_CREATE, 0640)
+	// Stage the kept tail in a durable temp file before dropping the old
+	// series: dropChunks below is a real delete, and the ChunkStore write
+	// that is supposed to replace it is a separate step that can itself
+	// fail or crash. Without this, a crash between the drop and the
+	// rewrite loses the tail outright; with it, the tail is recoverable
+	// from tempFileNameForFingerprint(fp) even if the rewrite below never
+	// completes.
+	tempName := p.tempFileNameForFingerprint(fp)
+	temp, err := os.OpenFile(tempName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
 	if err != nil {
 		return 0, false, err
 	}
-	defer temp.Close()
+	if _, err := temp.Write(tail); err != nil {
+		temp.Close()
+		return 0, false, err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return 0, false, err
+	}
+	if err := temp.Close(); err != nil {
+		return 0, false, err
+	}
 
-	if _, err := io.Copy(temp, f); err != nil {
+	if err := p.chunkStore.dropChunks(fp); err != nil {
 		return 0, false, err
 	}
 
-	if err := os.Rename(p.tempFileNameForFingerprint(fp), p.fileNameForFingerprint(fp)); err != nil {
+	w, err := p.openChunkFileForWriting(fp)
+	if err != nil {
 		return 0, false, err
 	}
+	if _, err := w.Write(tail); err != nil {
+		w.Close()
+		return 0, false, err
+	}
+	// Some ChunkStores only store what was written when the writer is
+	// closed, so the staged copy is removed only after Close succeeds.
+	if err := w.Close(); err != nil {
+		return 0, false, err
+	}
+	if err := os.Remove(tempName); err != nil && !os.IsNotExist(err) {
+		return i, false, err
+	}
 	return i, false, nil
 }
 
@@ -991,6 +1688,49 @@ func (p *persistence) getArchivedMetric(fp clientmodel.Fingerprint) (clientmodel
 	return metric, err
 }
 
+// GetMappedFingerprint resolves met's fast fingerprint fastFP to the
+// fingerprint its series is actually stored under, transparently mapping
+// around a fast-fingerprint collision the first time one occurs for met.
+// Query-path methods like GetFingerprintsForLabelMatchers and
+// GetMetricForFingerprint must call through this (as must AppendSamples
+// on ingestion) rather than ever using a fast fingerprint directly, and
+// fingerprintLocker's lock must be taken on the fingerprint this returns,
+// not on fastFP.
+//
+// This method is goroutine-safe.
+func (p *persistence) GetMappedFingerprint(fastFP clientmodel.Fingerprint, met clientmodel.Metric) clientmodel.Fingerprint {
+	return p.fpMapper.mapFP(fastFP, met)
+}
+
+// fpInUseOnDisk reports whether fp already belongs to an archived series.
+// It is persistence's contribution to fpMapper's fpInUse callback; a
+// complete answer also has to account for in-memory live series, which
+// only the Storage implementation owning series.go can supply, so this
+// alone understates "in use" until that wiring exists in this tree.
+func (p *persistence) fpInUseOnDisk(fp clientmodel.Fingerprint) bool {
+	_, ok, err := p.archivedFingerprintToMetrics.Lookup(fp)
+	if err != nil {
+		glog.Warningf("Could not look up archived metric for fingerprint %v: %s", fp, err)
+		return false
+	}
+	return ok
+}
+
+// GetMetricFamilyMetadataForFingerprint returns the HELP/TYPE metadata
+// AppendMetricFamilies last recorded for fp's series, if any. Looking up
+// a fingerprint with no recorded metadata is not an error; in that case,
+// (index.MetricFamilyMetadata{}, false) is returned.
+//
+// This method is goroutine-safe.
+func (p *persistence) GetMetricFamilyMetadataForFingerprint(fp clientmodel.Fingerprint) (index.MetricFamilyMetadata, bool) {
+	md, ok, err := p.metricFamilyMetadata.Lookup(fp)
+	if err != nil {
+		glog.Warningf("Could not look up metric family metadata for fingerprint %v: %s", fp, err)
+		return index.MetricFamilyMetadata{}, false
+	}
+	return md, ok
+}
+
 // dropArchivedMetric deletes an archived fingerprint and its corresponding
 // metric entirely. It also queues the metric for un-indexing (no need to call
 // unindexMetric for the deleted metric.)  This method is goroutine-safe.
@@ -1036,10 +1776,15 @@ func (p *persistence) unarchiveMetric(fp clientmodel.Fingerprint) (bool, error)
 // held resources. It also removes the dirty marker file if successful and if
 // the persistence is currently not marked as dirty.
 func (p *persistence) close() error {
+	p.cleanupCancel()
 	close(p.indexingQueue)
 	<-p.indexingStopped
 
 	var lastError error
+	if err := p.wal.Close(); err != nil {
+		lastError = err
+		glog.Error("Error closing WAL: ", err)
+	}
 	if err := p.archivedFingerprintToMetrics.Close(); err != nil {
 		lastError = err
 		glog.Error("Error closing archivedFingerprintToMetric index DB: ", err)
@@ -1056,6 +1801,10 @@ func (p *persistence) close() error {
 		lastError = err
 		glog.Error("Error closing labelNameToLabelValues index DB: ", err)
 	}
+	if err := p.fingerprintToExemplars.Close(); err != nil {
+		lastError = err
+		glog.Error("Error closing fingerprintToExemplars index DB: ", err)
+	}
 	if lastError == nil && !p.dirty {
 		lastError = os.Remove(p.dirtyFileName())
 	}
@@ -1077,40 +1826,78 @@ func (p *persistence) tempFileNameForFingerprint(fp clientmodel.Fingerprint) str
 	return path.Join(p.basePath, fpStr[0:2], fpStr[2:]+seriesTempFileSuffix)
 }
 
-func (p *persistence) openChunkFileForWriting(fp clientmodel.Fingerprint) (*os.File, error) {
-	if err := os.MkdirAll(p.dirNameForFingerprint(fp), 0700); err != nil {
-		return nil, err
+func (p *persistence) openChunkFileForWriting(fp clientmodel.Fingerprint) (io.WriteCloser, error) {
+	return p.chunkStore.openChunkFileForWriting(fp)
+}
+
+func (p *persistence) openChunkFileForReading(fp clientmodel.Fingerprint) (chunkFileReader, error) {
+	return p.chunkStore.openChunkFileForReading(fp)
+}
+
+// enableColdStorageMigration reconfigures p.chunkStore to keep series newer
+// than threshold on its current (local or block) store and move everything
+// else into remote, then starts a background loop that periodically
+// migrates archived series that just crossed threshold. Nothing in this
+// tree constructs a concrete ObjectStore (there is no bundled S3/GCS/Azure
+// client), so this is never called from newPersistence itself; it exists
+// for a caller that embeds persistence and supplies its own ObjectStore.
+func (p *persistence) enableColdStorageMigration(remote ObjectStore, threshold time.Duration, interval time.Duration) {
+	ts := newAgeThresholdChunkStore(p.chunkStore, newRemoteChunkStore(remote), threshold, p.lastSampleTime)
+	p.chunkStore = ts
+	go p.runColdSeriesMigrator(ts, interval)
+}
+
+// lastSampleTime reports the most recent sample time persisted for fp, used
+// by ageThresholdChunkStore to decide whether fp has aged out of local
+// storage. A fingerprint with no archived time range (still actively
+// appended to) is never cold.
+func (p *persistence) lastSampleTime(fp clientmodel.Fingerprint) clientmodel.Timestamp {
+	_, lastTime, ok, err := p.archivedFingerprintToTimeRange.Lookup(fp)
+	if err != nil || !ok {
+		return clientmodel.Timestamp(time.Now().UnixNano() / int64(time.Millisecond))
 	}
-	return os.OpenFile(p.fileNameForFingerprint(fp), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	return lastTime
 }
 
-func (p *persistence) openChunkFileForReading(fp clientmodel.Fingerprint) (*os.File, error) {
-	return os.Open(p.fileNameForFingerprint(fp))
+// runColdSeriesMigrator periodically migrates archived series that have
+// aged past ts's threshold from local to remote storage, mirroring
+// runTombstoneCompactor's loop.
+func (p *persistence) runColdSeriesMigrator(ts *ageThresholdChunkStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.cleanupCtx.Done():
+			return
+		case <-ticker.C:
+			cutoff := clientmodel.Timestamp(time.Now().Add(-ts.threshold).UnixNano() / int64(time.Millisecond))
+			fps, err := p.getFingerprintsModifiedBefore(cutoff)
+			if err != nil {
+				glog.Warningf("Could not determine fingerprints eligible for cold storage migration: %s", err)
+				continue
+			}
+			for _, fp := range fps {
+				if !ts.isCold(fp) {
+					continue
+				}
+				if err := ts.migrateColdSeries(fp); err != nil {
+					glog.Warningf("Could not migrate fingerprint %v to cold storage: %s", fp, err)
+				}
+			}
+		}
+	}
 }
 
-func writeChunkHeader(w io.Writer, c chunk) error {
+func writeChunkHeader(w io.Writer, c chunk, compression chunkCompression) error {
 	header := make([]byte, chunkHeaderLen)
-	header[chunkHeaderTypeOffset] = chunkType(c)
+	header[chunkHeaderTypeOffset] = packTypeByte(chunkType(c), compression)
 	binary.LittleEndian.PutUint64(header[chunkHeaderFirstTimeOffset:], uint64(c.firstTime()))
 	binary.LittleEndian.PutUint64(header[chunkHeaderLastTimeOffset:], uint64(c.lastTime()))
 	_, err := w.Write(header)
 	return err
 }
 
-func (p *persistence) offsetForChunkIndex(i int) int64 {
-	return int64(i * (chunkHeaderLen + p.chunkLen))
-}
-
-func (p *persistence) chunkIndexForOffset(offset int64) (int, error) {
-	if int(offset)%(chunkHeaderLen+p.chunkLen) != 0 {
-		return -1, fmt.Errorf(
-			"offset %d is not a multiple of on-disk chunk length %d",
-			offset, chunkHeaderLen+p.chunkLen,
-		)
-	}
-	return int(offset) / (chunkHeaderLen + p.chunkLen), nil
-}
-
 func (p *persistence) headsFileName() string {
 	return path.Join(p.basePath, headsFileName)
 }
@@ -1119,6 +1906,42 @@ func (p *persistence) headsTempFileName() string {
 	return path.Join(p.basePath, headsTempFileName)
 }
 
+// headsGenerationFileName returns the heads file name for generation gen,
+// where generation 0 is the current checkpoint (heads.db) and generation
+// n>0 is the n-th most recent previous one (heads.db.n).
+func (p *persistence) headsGenerationFileName(gen int) string {
+	if gen == 0 {
+		return p.headsFileName()
+	}
+	return fmt.Sprintf("%s.%d", p.headsFileName(), gen)
+}
+
+// rotateHeadsGenerations shifts heads.db.1 -> heads.db.2 -> ... -> (dropped)
+// and finally heads.db -> heads.db.1, making room for a freshly written
+// checkpoint to be renamed into heads.db. It is a no-op for generations
+// that don't exist on disk yet.
+func (p *persistence) rotateHeadsGenerations() error {
+	for gen := headsNumGenerations - 1; gen >= 1; gen-- {
+		oldName := p.headsGenerationFileName(gen)
+		newName := p.headsGenerationFileName(gen + 1)
+		if gen+1 >= headsNumGenerations {
+			if err := os.Remove(oldName); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := os.Rename(oldName, newName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(p.headsFileName(), p.headsGenerationFileName(1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
 func (p *persistence) processIndexingQueue() {
 	batchSize := 0
 	nameToValues := index.LabelNameLabelValuesMapping{}
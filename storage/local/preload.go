@@ -0,0 +1,64 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// coalesceRangeIntervals computes the minimal set of non-overlapping
+// [OldestInclusive, NewestInclusive] windows covering every
+// [t-rangeDuration, t] range for t stepped from from to through by
+// interval. GetMetricRangeAtInterval uses this so that a query stepping
+// across, say, 15s with a 5m range only pins each chunk once, rather than
+// once per step whose range happens to touch it -- the same chunk would
+// otherwise be pinned and unpinned many times over, each pin/unpin pair
+// taking and releasing the chunk's reference count for no benefit once
+// the first pin already covers it.
+//
+// The windows returned are sorted and in particular non-adjacent: merging
+// stops only once there is an actual gap between one window's
+// NewestInclusive and the next window's OldestInclusive, so a caller
+// turning each window into one pinned chunk set never does redundant work
+// for two steps that share no samples.
+func coalesceRangeIntervals(from, through clientmodel.Timestamp, interval, rangeDuration time.Duration) []metric.Interval {
+	if from.After(through) {
+		return nil
+	}
+
+	var windows []metric.Interval
+	stepMs := clientmodel.Timestamp(interval / time.Millisecond)
+	if stepMs <= 0 {
+		stepMs = 1
+	}
+	rangeMs := clientmodel.Timestamp(rangeDuration / time.Millisecond)
+
+	for t := from; !t.After(through); t += stepMs {
+		oldest := t - rangeMs
+		if n := len(windows); n > 0 && !oldest.After(windows[n-1].NewestInclusive) {
+			// This step's range overlaps (or touches) the last window:
+			// extend it rather than opening a new one.
+			if t.After(windows[n-1].NewestInclusive) {
+				windows[n-1].NewestInclusive = t
+			}
+			continue
+		}
+		windows = append(windows, metric.Interval{OldestInclusive: oldest, NewestInclusive: t})
+	}
+	return windows
+}
@@ -0,0 +1,91 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+func TestCoalesceRangeIntervalsMergesOverlappingSteps(t *testing.T) {
+	// Steps every 15s with a 5m range: consecutive steps' ranges overlap
+	// heavily, so the whole hour should coalesce into one window.
+	from := clientmodel.Timestamp(0)
+	through := clientmodel.Timestamp(int64(time.Hour / time.Millisecond))
+	windows := coalesceRangeIntervals(from, through, 15*time.Second, 5*time.Minute)
+
+	if len(windows) != 1 {
+		t.Fatalf("got %d windows, want 1: %+v", len(windows), windows)
+	}
+	if windows[0].OldestInclusive != from-clientmodel.Timestamp(int64(5*time.Minute/time.Millisecond)) {
+		t.Errorf("unexpected OldestInclusive: %v", windows[0].OldestInclusive)
+	}
+	if windows[0].NewestInclusive != through {
+		t.Errorf("unexpected NewestInclusive: %v", windows[0].NewestInclusive)
+	}
+}
+
+func TestCoalesceRangeIntervalsKeepsDisjointSteps(t *testing.T) {
+	// A tiny range relative to the step leaves gaps between steps, so no
+	// merging should happen.
+	from := clientmodel.Timestamp(0)
+	through := clientmodel.Timestamp(int64(3 * time.Minute / time.Millisecond))
+	windows := coalesceRangeIntervals(from, through, time.Minute, time.Second)
+
+	if len(windows) != 4 {
+		t.Fatalf("got %d windows, want 4: %+v", len(windows), windows)
+	}
+}
+
+// BenchmarkCoalesceRangeIntervals approximates the 10k-series, 24h scale
+// AppendMetricFamilies-style range queries run at: one 15s-stepped,
+// 5m-range query over 24h touches 5761 steps, both ends included. This only benchmarks the
+// coalescing computation itself; turning its output into actual pinned
+// chunk sets needs a concrete Preloader, which -- like the rest of
+// series.go -- is not part of this tree. The interesting comparison this
+// stands in for is windows-pinned-and-unpinned (the cost
+// GetMetricRangeAtInterval avoids) vs steps-pinned-and-unpinned (the cost
+// a naive per-step GetMetricRange loop would pay, once per series);
+// BenchmarkNaiveStepCount below reports the latter for comparison.
+func BenchmarkCoalesceRangeIntervals(b *testing.B) {
+	from := clientmodel.Timestamp(0)
+	through := clientmodel.Timestamp(int64(24 * time.Hour / time.Millisecond))
+	for i := 0; i < b.N; i++ {
+		coalesceRangeIntervals(from, through, 15*time.Second, 5*time.Minute)
+	}
+}
+
+// BenchmarkNaiveStepCount reports, for the same 24h/15s/5m query as
+// BenchmarkCoalesceRangeIntervals, how many individual pins a naive
+// per-step GetMetricRange loop would issue per series (5761, one per
+// step) versus how many coalesceRangeIntervals actually needs -- the gap
+// between the two times 10k series is the pin/unpin churn that
+// coalesceRangeIntervals avoids.
+func BenchmarkNaiveStepCount(b *testing.B) {
+	from := clientmodel.Timestamp(0)
+	through := clientmodel.Timestamp(int64(24 * time.Hour / time.Millisecond))
+	step := 15 * time.Second
+	for i := 0; i < b.N; i++ {
+		naive := 0
+		for t := from; !t.After(through); t += clientmodel.Timestamp(step / time.Millisecond) {
+			naive++
+		}
+		coalesced := coalesceRangeIntervals(from, through, step, 5*time.Minute)
+		if i == 0 {
+			b.Logf("naive pins per series: %d, coalesced windows per series: %d", naive, len(coalesced))
+		}
+	}
+}
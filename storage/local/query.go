@@ -0,0 +1,236 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"regexp"
+	"sort"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// matchType is the kind of comparison a matcher applies to a label value.
+type matchType int
+
+const (
+	matchEqual matchType = iota
+	matchRegexp
+)
+
+// matcher constrains the value of a single label name, either to an exact
+// value or to anything matching a regular expression. It is the unit
+// queryFingerprints' set algebra operates on; each matcher contributes one
+// posting list (the union of every label value it matches), and the
+// matchers of a query are combined by intersecting theirs.
+type matcher struct {
+	name  clientmodel.LabelName
+	typ   matchType
+	value clientmodel.LabelValue
+	re    *regexp.Regexp
+}
+
+// newEqualMatcher returns a matcher requiring name to have exactly value.
+func newEqualMatcher(name clientmodel.LabelName, value clientmodel.LabelValue) *matcher {
+	return &matcher{name: name, typ: matchEqual, value: value}
+}
+
+// newRegexpMatcher returns a matcher requiring name's value to match
+// pattern, anchored the way RE2 (and thus Go's regexp package) treats an
+// unanchored pattern passed to MatchString: nowhere in particular, so
+// callers wanting a full-string match should anchor pattern themselves
+// with ^...$.
+func newRegexpMatcher(name clientmodel.LabelName, pattern string) (*matcher, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &matcher{name: name, typ: matchRegexp, re: re}, nil
+}
+
+// queryFingerprints returns the fingerprints whose metric satisfies every
+// matcher, without ever materializing a full posting list as a Go map: each
+// matcher's contribution is fetched as a sorted clientmodel.Fingerprints
+// slice (the label-pair index's Lookup, not its map-returning LookupSet),
+// and matchers are combined with a streaming sorted-list intersection
+// rather than building up intermediate sets. A regexp matcher is first
+// reduced to the union of whichever label values under labelNameToLabelValues
+// actually match the pattern, so only the (usually much smaller) set of
+// matching values' posting lists is ever fetched, rather than every
+// fingerprint that has the label name at all.
+//
+// This method is goroutine-safe but, like getFingerprintsForLabelPair,
+// takes into account that metrics queued for indexing via indexMetric might
+// not yet have made it into the index.
+func (p *persistence) queryFingerprints(matchers []*matcher) (clientmodel.Fingerprints, error) {
+	if len(matchers) == 0 {
+		return nil, nil
+	}
+
+	var result clientmodel.Fingerprints
+	for i, m := range matchers {
+		postings, err := p.postingsForMatcher(m)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			result = postings
+			continue
+		}
+		result = intersectSortedFingerprints(result, postings)
+		if len(result) == 0 {
+			return nil, nil
+		}
+	}
+	return result, nil
+}
+
+// postingsForMatcher returns the sorted, duplicate-free set of fingerprints
+// matching m.
+func (p *persistence) postingsForMatcher(m *matcher) (clientmodel.Fingerprints, error) {
+	if m.typ == matchEqual {
+		fps, err := p.getFingerprintsForLabelPair(metric.LabelPair{Name: m.name, Value: m.value})
+		if err != nil {
+			return nil, err
+		}
+		return sortFingerprints(fps), nil
+	}
+
+	values, err := p.getLabelValuesForLabelName(m.name)
+	if err != nil {
+		return nil, err
+	}
+
+	var union clientmodel.Fingerprints
+	for _, v := range values {
+		if !m.re.MatchString(string(v)) {
+			continue
+		}
+		fps, err := p.getFingerprintsForLabelPair(metric.LabelPair{Name: m.name, Value: v})
+		if err != nil {
+			return nil, err
+		}
+		union = unionSortedFingerprints(union, sortFingerprints(fps))
+	}
+	return union, nil
+}
+
+// fingerprintSlice attaches sort.Interface to clientmodel.Fingerprints so it
+// can be sorted without assuming the index already persisted it that way.
+type fingerprintSlice clientmodel.Fingerprints
+
+func (s fingerprintSlice) Len() int           { return len(s) }
+func (s fingerprintSlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s fingerprintSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func sortFingerprints(fps clientmodel.Fingerprints) clientmodel.Fingerprints {
+	sort.Sort(fingerprintSlice(fps))
+	return fps
+}
+
+// intersectSortedFingerprints returns the sorted intersection of a and b,
+// both already sorted ascending, via a galloping merge: advancing through
+// the shorter list one element at a time while skip-searching the longer
+// one in exponentially growing strides, which beats a plain linear merge
+// when one posting list is much larger than the other (the common case --
+// a selective label pair intersected against a broad one).
+func intersectSortedFingerprints(a, b clientmodel.Fingerprints) clientmodel.Fingerprints {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	var out clientmodel.Fingerprints
+	bi := 0
+	for _, fp := range a {
+		var found bool
+		bi, found = gallopingFind(b, bi, fp)
+		if found {
+			out = append(out, fp)
+		}
+		if bi >= len(b) {
+			break
+		}
+	}
+	return out
+}
+
+// unionSortedFingerprints returns the sorted, duplicate-free union of a and
+// b, both already sorted ascending.
+func unionSortedFingerprints(a, b clientmodel.Fingerprints) clientmodel.Fingerprints {
+	out := make(clientmodel.Fingerprints, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			out = append(out, a[i])
+			i++
+		case a[i] > b[j]:
+			out = append(out, b[j])
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	out = append(out, a[i:]...)
+	out = append(out, b[j:]...)
+	return out
+}
+
+// gallopingFind looks for target in b[from:], which must be sorted
+// ascending, starting with exponentially growing strides (1, 2, 4, ...)
+// before binary-searching the bracket the stride overshot into. It returns
+// the index of target (found == true) or the index of the first element
+// greater than target (found == false), either way suitable as the next
+// call's from so repeated lookups for an ascending sequence of targets
+// never revisit earlier elements.
+func gallopingFind(b clientmodel.Fingerprints, from int, target clientmodel.Fingerprint) (idx int, found bool) {
+	if from >= len(b) {
+		return len(b), false
+	}
+	if b[from] > target {
+		// Nothing skipped since the last call; a plain binary search
+		// over the remaining slice is all galloping degenerates to.
+		return binarySearchFingerprints(b, from, target)
+	}
+	stride := 1
+	lo := from
+	hi := from
+	for hi < len(b) && b[hi] < target {
+		lo = hi
+		hi += stride
+		stride *= 2
+	}
+	if hi > len(b) {
+		hi = len(b)
+	}
+	return binarySearchFingerprints(b, lo, target, hi)
+}
+
+// binarySearchFingerprints searches b[lo:hi] (hi defaults to len(b) if
+// omitted) for target.
+func binarySearchFingerprints(b clientmodel.Fingerprints, lo int, target clientmodel.Fingerprint, hi ...int) (int, bool) {
+	end := len(b)
+	if len(hi) > 0 {
+		end = hi[0]
+	}
+	i := lo + sort.Search(end-lo, func(i int) bool {
+		return b[lo+i] >= target
+	})
+	if i < len(b) && b[i] == target {
+		return i, true
+	}
+	return i, false
+}
@@ -0,0 +1,134 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+func fps(vs ...int) clientmodel.Fingerprints {
+	out := make(clientmodel.Fingerprints, len(vs))
+	for i, v := range vs {
+		out[i] = clientmodel.Fingerprint(v)
+	}
+	return out
+}
+
+func TestGallopingFindEmptySlice(t *testing.T) {
+	idx, found := gallopingFind(fps(), 0, 5)
+	if found {
+		t.Errorf("found = true on an empty slice")
+	}
+	if idx != 0 {
+		t.Errorf("got idx %d, want 0", idx)
+	}
+}
+
+func TestGallopingFindTargetEqualsFirstProbed(t *testing.T) {
+	b := fps(1, 2, 3, 4, 5)
+	idx, found := gallopingFind(b, 0, 1)
+	if !found || idx != 0 {
+		t.Errorf("got (%d, %v), want (0, true)", idx, found)
+	}
+}
+
+func TestGallopingFindTargetPastEnd(t *testing.T) {
+	b := fps(1, 2, 3, 4, 5)
+	idx, found := gallopingFind(b, 0, 10)
+	if found {
+		t.Errorf("found = true for a target past the end")
+	}
+	if idx != len(b) {
+		t.Errorf("got idx %d, want %d", idx, len(b))
+	}
+}
+
+func TestGallopingFindTargetNotPresentBetweenElements(t *testing.T) {
+	b := fps(1, 3, 5, 7, 9, 11, 13)
+	idx, found := gallopingFind(b, 0, 6)
+	if found {
+		t.Errorf("found = true for an absent target")
+	}
+	if idx != 3 || b[idx] != 7 {
+		t.Errorf("got idx %d (value %d), want 3 (value 7)", idx, b[idx])
+	}
+}
+
+func TestGallopingFindResumesFromPreviousIndex(t *testing.T) {
+	// A repeated call with from set to the previous result must not
+	// revisit anything before it, even though the target it's now
+	// looking for comes right after what was just found.
+	b := fps(1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	idx, found := gallopingFind(b, 0, 3)
+	if !found || idx != 2 {
+		t.Fatalf("got (%d, %v), want (2, true)", idx, found)
+	}
+	idx, found = gallopingFind(b, idx, 7)
+	if !found || idx != 6 {
+		t.Errorf("got (%d, %v), want (6, true)", idx, found)
+	}
+}
+
+func TestIntersectSortedFingerprints(t *testing.T) {
+	cases := []struct {
+		a, b, want clientmodel.Fingerprints
+	}{
+		{fps(), fps(), fps()},
+		{fps(1, 2, 3), fps(), nil},
+		{fps(), fps(1, 2, 3), nil},
+		{fps(1, 2, 3), fps(2, 3, 4), fps(2, 3)},
+		{fps(1, 2, 3), fps(4, 5, 6), nil},
+		{fps(1, 2, 3), fps(1, 2, 3), fps(1, 2, 3)},
+		// b much larger than a, exercising the galloping strides.
+		{fps(50), fps(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 20, 30, 40, 50, 60), fps(50)},
+	}
+	for _, c := range cases {
+		got := intersectSortedFingerprints(c.a, c.b)
+		if !reflect.DeepEqual(toSlice(got), toSlice(c.want)) {
+			t.Errorf("intersectSortedFingerprints(%v, %v) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestUnionSortedFingerprints(t *testing.T) {
+	cases := []struct {
+		a, b, want clientmodel.Fingerprints
+	}{
+		{fps(), fps(), fps()},
+		{fps(1, 2, 3), fps(), fps(1, 2, 3)},
+		{fps(), fps(1, 2, 3), fps(1, 2, 3)},
+		{fps(1, 3, 5), fps(2, 4, 6), fps(1, 2, 3, 4, 5, 6)},
+		{fps(1, 2, 3), fps(1, 2, 3), fps(1, 2, 3)},
+		{fps(1, 2), fps(2, 3), fps(1, 2, 3)},
+	}
+	for _, c := range cases {
+		got := unionSortedFingerprints(c.a, c.b)
+		if !reflect.DeepEqual(toSlice(got), toSlice(c.want)) {
+			t.Errorf("unionSortedFingerprints(%v, %v) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+// toSlice normalizes a possibly-nil clientmodel.Fingerprints to a non-nil
+// []clientmodel.Fingerprint so reflect.DeepEqual doesn't distinguish an
+// empty result from a nil one, which none of these functions' callers do
+// either.
+func toSlice(fps clientmodel.Fingerprints) []clientmodel.Fingerprint {
+	out := make([]clientmodel.Fingerprint, len(fps))
+	copy(out, fps)
+	return out
+}
@@ -0,0 +1,205 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// ObjectStore is the minimal abstraction remoteChunkStore needs from an
+// object-storage client (S3, GCS, Azure Blob, ...): whole-object get/put/
+// delete keyed by an opaque string.
+type ObjectStore interface {
+	Get(key string) ([]byte, error)
+	Put(key string, data []byte) error
+	Delete(key string) error
+}
+
+// remoteChunkStore is a ChunkStore backed by an ObjectStore. Because most
+// object stores have no efficient append, a whole series file is read
+// whole, mutated in memory, and written back whole; this is acceptable
+// because remoteChunkStore is only used for series that have already aged
+// past ageThresholdChunkStore's threshold and are no longer receiving
+// fresh samples.
+type remoteChunkStore struct {
+	store ObjectStore
+}
+
+// newRemoteChunkStore returns a ChunkStore backed by store, ready to use.
+func newRemoteChunkStore(store ObjectStore) *remoteChunkStore {
+	return &remoteChunkStore{store: store}
+}
+
+func objectKey(fp clientmodel.Fingerprint) string {
+	return "chunks/" + fp.String() + seriesFileSuffix
+}
+
+// closingByteReader adapts a *bytes.Reader, which has no Close method, to
+// chunkFileReader: the whole object is already in memory by the time a
+// caller gets one, so Close has nothing to release.
+type closingByteReader struct {
+	*bytes.Reader
+}
+
+func (closingByteReader) Close() error { return nil }
+
+func (s *remoteChunkStore) openChunkFileForReading(fp clientmodel.Fingerprint) (chunkFileReader, error) {
+	data, err := s.store.Get(objectKey(fp))
+	if err != nil {
+		return nil, err
+	}
+	return closingByteReader{bytes.NewReader(data)}, nil
+}
+
+// remoteWriteCloser buffers appended bytes in memory and flushes the whole
+// object on Close, since object stores generally only support whole-object
+// PUT.
+type remoteWriteCloser struct {
+	store ObjectStore
+	key   string
+	buf   bytes.Buffer
+}
+
+func (s *remoteChunkStore) openChunkFileForWriting(fp clientmodel.Fingerprint) (io.WriteCloser, error) {
+	key := objectKey(fp)
+	existing, err := s.store.Get(key)
+	if err != nil {
+		existing = nil // Treat "not found" the same as a fresh series.
+	}
+	w := &remoteWriteCloser{store: s.store, key: key}
+	w.buf.Write(existing)
+	return w, nil
+}
+
+func (w *remoteWriteCloser) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *remoteWriteCloser) Close() error {
+	return w.store.Put(w.key, w.buf.Bytes())
+}
+
+func (s *remoteChunkStore) dropChunks(fp clientmodel.Fingerprint) error {
+	return s.store.Delete(objectKey(fp))
+}
+
+func (s *remoteChunkStore) sanitizeSeries(fp clientmodel.Fingerprint) (int64, error) {
+	data, err := s.store.Get(objectKey(fp))
+	if err != nil {
+		return 0, nil
+	}
+	return int64(len(data)), nil
+}
+
+// ageThresholdChunkStore dispatches to a local ChunkStore for series that
+// have samples newer than threshold, and to a remote ChunkStore for series
+// that have fully aged out, so that "cold" chunk files can be transparently
+// offloaded to an object store while hot series keep the cheap local-disk
+// append path.
+type ageThresholdChunkStore struct {
+	local, remote ChunkStore
+	threshold     time.Duration
+	// lastModified reports the most recent sample time for a
+	// fingerprint; persistence wires this to its lastSampleTime, which
+	// reads the archived time range and reports an unarchived series as
+	// modified now.
+	lastModified func(clientmodel.Fingerprint) clientmodel.Timestamp
+}
+
+// newAgeThresholdChunkStore returns a ChunkStore that keeps series younger
+// than threshold on local, and moves everything else to remote.
+// lastModified supplies the age of a given fingerprint's most recent
+// sample.
+func newAgeThresholdChunkStore(
+	local, remote ChunkStore,
+	threshold time.Duration,
+	lastModified func(clientmodel.Fingerprint) clientmodel.Timestamp,
+) *ageThresholdChunkStore {
+	return &ageThresholdChunkStore{
+		local:        local,
+		remote:       remote,
+		threshold:    threshold,
+		lastModified: lastModified,
+	}
+}
+
+func (s *ageThresholdChunkStore) isCold(fp clientmodel.Fingerprint) bool {
+	age := time.Since(s.lastModified(fp).Time())
+	return age > s.threshold
+}
+
+func (s *ageThresholdChunkStore) storeFor(fp clientmodel.Fingerprint) ChunkStore {
+	if s.isCold(fp) {
+		return s.remote
+	}
+	return s.local
+}
+
+func (s *ageThresholdChunkStore) openChunkFileForReading(fp clientmodel.Fingerprint) (chunkFileReader, error) {
+	// A cold series might already have been migrated; a series that is
+	// still warm is always local. Try local first and fall back to
+	// remote, since migration only moves data one way (local -> remote).
+	r, err := s.local.openChunkFileForReading(fp)
+	if err == nil {
+		return r, nil
+	}
+	return s.remote.openChunkFileForReading(fp)
+}
+
+func (s *ageThresholdChunkStore) openChunkFileForWriting(fp clientmodel.Fingerprint) (io.WriteCloser, error) {
+	return s.storeFor(fp).openChunkFileForWriting(fp)
+}
+
+func (s *ageThresholdChunkStore) dropChunks(fp clientmodel.Fingerprint) error {
+	if err := s.local.dropChunks(fp); err != nil {
+		return err
+	}
+	return s.remote.dropChunks(fp)
+}
+
+func (s *ageThresholdChunkStore) sanitizeSeries(fp clientmodel.Fingerprint) (int64, error) {
+	return s.storeFor(fp).sanitizeSeries(fp)
+}
+
+// migrateColdSeries copies a cold series' chunk file from local to remote
+// storage and removes the local copy. persistence.runColdSeriesMigrator
+// invokes it periodically for archived fingerprints that have crossed the
+// age threshold.
+func (s *ageThresholdChunkStore) migrateColdSeries(fp clientmodel.Fingerprint) error {
+	r, err := s.local.openChunkFileForReading(fp)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	w, err := s.remote.openChunkFileForWriting(fp)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return s.local.dropChunks(fp)
+}
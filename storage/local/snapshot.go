@@ -0,0 +1,235 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/prometheus/storage/local/index"
+)
+
+// Snapshot writes a consistent, point-in-time copy of the persistence
+// layer's on-disk layout (the two-char fingerprint subdirectories of series
+// files, the heads checkpoint and its rollback generations, the WAL, and
+// the LevelDB-backed indexes) into dir, which must not already exist.
+//
+// Only files that are finalized by an atomic rename before anything else
+// can observe them -- the heads checkpoint generations, and the
+// LevelDB-backed indexes -- are hard-linked (falling back to a full copy
+// transparently if dir and basePath do not share a filesystem). Series
+// files and the WAL are appended to in place for as long as they exist
+// (persistChunk and wal.logRecord never finalize one via rename), so a hard
+// link to either would be the very same inode as the live file: "snapshot"
+// would keep drifting with the live database for as long as the directory
+// sits around, rather than being frozen at the moment Snapshot returns.
+// Those are copied instead, so they stop changing the instant the copy is
+// made, even though the live file next to them keeps growing.
+//
+// Snapshot flushes the indexing queue, holds archiveMtx for its duration to
+// keep archival bookkeeping from changing underfoot, and serializes against
+// dropChunks' file rewrites via snapshotMtx so a copied series file can
+// never be caught half-rewritten. It does not otherwise stop ingestion: a
+// copied series file may or may not include samples appended concurrently
+// with the snapshot, the same way a backup of any append-only log handles
+// concurrent writers, but once Snapshot returns, dir itself does not change
+// again. The result is safe to archive with rsync or tar at any later time;
+// Restore reverses it.
+func (p *persistence) Snapshot(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("snapshot destination %s already exists", dir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	p.waitForIndexing()
+	p.archiveMtx.Lock()
+	defer p.archiveMtx.Unlock()
+	p.snapshotMtx.Lock()
+	defer p.snapshotMtx.Unlock()
+
+	if err := p.wal.flushAndSync(); err != nil {
+		return err
+	}
+
+	for i := 0; i < 256; i++ {
+		name := fmt.Sprintf("%02x", i)
+		src := path.Join(p.basePath, name)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := copyTree(src, path.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	for gen := 0; gen < headsNumGenerations; gen++ {
+		src := p.headsGenerationFileName(gen)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := linkFile(src, path.Join(dir, filepath.Base(src))); err != nil {
+			return err
+		}
+	}
+
+	walSrc := path.Join(p.basePath, walDirName)
+	if _, err := os.Stat(walSrc); err == nil {
+		if err := copyTree(walSrc, path.Join(dir, walDirName)); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, idxDir := range index.Dirs() {
+		if err := linkTree(path.Join(p.basePath, idxDir), path.Join(dir, idxDir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore swaps the on-disk layout previously written by Snapshot (at
+// snapshotDir) into basePath, which must not exist or must be empty. It
+// walks every series file via walkChunkFile to validate that each chunk
+// record's header is well-formed before the snapshot is trusted, so a
+// truncated or otherwise corrupt snapshot is rejected up front rather than
+// surfacing as confusing errors (or silent data loss) much later during
+// normal operation.
+func Restore(snapshotDir, basePath string, chunkLen int) error {
+	if fis, err := ioutil.ReadDir(basePath); err == nil && len(fis) > 0 {
+		return fmt.Errorf("restore destination %s is not empty", basePath)
+	}
+
+	if err := filepath.Walk(snapshotDir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !strings.HasSuffix(p, seriesFileSuffix) {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		entries, err := walkChunkFile(f, chunkLen)
+		if err != nil {
+			return fmt.Errorf("corrupt snapshot: %s: %s", p, err)
+		}
+		fi, err = f.Stat()
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			last := entries[len(entries)-1]
+			if last.offset+last.length != fi.Size() {
+				return fmt.Errorf("corrupt snapshot: %s: trailing %d bytes after last complete chunk", p, fi.Size()-(last.offset+last.length))
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(basePath), 0700); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(basePath); err != nil {
+		return err
+	}
+	return linkTree(snapshotDir, basePath)
+}
+
+// linkFile hard-links src to dst, falling back to a full copy if the two
+// paths are not on the same filesystem (the only common reason for
+// os.Link to fail with a *LinkError wrapping syscall.EXDEV).
+func linkFile(src, dst string) error {
+	if err := os.MkdirAll(path.Dir(dst), 0700); err != nil {
+		return err
+	}
+	if err := os.Link(src, dst); err != nil {
+		if os.IsExist(err) {
+			return err
+		}
+		return copyFile(src, dst)
+	}
+	return nil
+}
+
+// linkTree recursively hard-links every regular file under src into the
+// same relative location under dst, creating directories as needed.
+func linkTree(src, dst string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		return linkFile(p, target)
+	})
+}
+
+// copyTree recursively copies every regular file under src into the same
+// relative location under dst, creating directories as needed. Unlike
+// linkTree, the copies are independent of src's inodes, so they stop
+// changing the instant copyTree returns even if src keeps being appended
+// to afterwards -- required for anything still open for live in-place
+// append, such as series files and the WAL.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		return copyFile(p, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
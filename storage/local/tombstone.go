@@ -0,0 +1,495 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+const (
+	tombstoneFileName = "tombstones.db"
+	// tombstoneRecordLen is the length, in bytes, of one on-disk tombstone
+	// record: fingerprint, from, and to are each a little-endian uint64.
+	// A CRC32 (IEEE), covering just those bytes, follows each record, the
+	// same framing wal.go uses for its own fixed-size records.
+	tombstoneRecordLen    = 24
+	tombstoneRecordOnDisk = tombstoneRecordLen + 4
+)
+
+var (
+	tombstoneCompactionThreshold = flag.Float64(
+		"storage.local.tombstone-compaction-threshold",
+		0.5,
+		"Fraction of a series file's chunks that must be covered by tombstones before it is rewritten to reclaim space.",
+	)
+	tombstoneCompactionIntervalFlag = flag.Duration(
+		"storage.local.tombstone-compaction-interval",
+		time.Hour,
+		"How often to scan for series whose tombstone density warrants compaction.",
+	)
+)
+
+// timeRange is a closed interval [from, to] of sample timestamps marked
+// deleted by a tombstone.
+type timeRange struct {
+	from, to clientmodel.Timestamp
+}
+
+// contains reports whether ts falls within r.
+func (r timeRange) contains(ts clientmodel.Timestamp) bool {
+	return !ts.Before(r.from) && !ts.After(r.to)
+}
+
+// covers reports whether a chunk spanning [first, last] lies entirely
+// within r, the only case compactTombstones will physically drop a chunk
+// for: a chunk merely overlapping a tombstone at one edge still has
+// samples outside the deleted range, and nothing in this package can trim
+// a chunk's body to just the surviving samples without decoding and
+// re-encoding it. loadChunkDescs uses the same test (via
+// chunkEntirelyTombstoned) to leave an entirely-covered chunk out of a
+// query's result before compaction ever runs; a chunk only partially
+// covered is still returned whole; a caller that needs those samples
+// excluded at the individual-sample level has to consult isDeleted itself
+// while iterating the chunk's decoded values, since no chunk encoding in
+// this package filters on read.
+func (r timeRange) covers(first, last clientmodel.Timestamp) bool {
+	return !first.Before(r.from) && !last.After(r.to)
+}
+
+// overlaps reports whether r and [first, last] share any timestamp.
+func (r timeRange) overlaps(first, last clientmodel.Timestamp) bool {
+	return !last.Before(r.from) && !first.After(r.to)
+}
+
+// tombstoneStore records the fingerprint/time-range deletions requested
+// through DeleteSeries. Records are appended to a per-shard log (sharded
+// the same way series files are, by the first two hex digits of the
+// fingerprint, under tombstoneFileName) and, like the heads checkpoint
+// and the block index, kept wholesale in memory: tombstones are metadata,
+// small relative to the chunk data they describe.
+//
+// A tombstoneStore only records deletions; it does not by itself reclaim
+// any space. That is compactTombstones' job, invoked periodically by
+// runTombstoneCompactor for fingerprints whose tombstone density crosses
+// tombstoneCompactionThreshold.
+type tombstoneStore struct {
+	basePath string
+
+	mtx    sync.RWMutex
+	ranges map[clientmodel.Fingerprint][]timeRange
+}
+
+// newTombstoneStore loads every shard's tombstone log under basePath into
+// memory.
+func newTombstoneStore(basePath string) (*tombstoneStore, error) {
+	s := &tombstoneStore{
+		basePath: basePath,
+		ranges:   map[clientmodel.Fingerprint][]timeRange{},
+	}
+	for i := 0; i < 256; i++ {
+		if err := s.loadShard(fmt.Sprintf("%02x", i)); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *tombstoneStore) shardFileName(shard string) string {
+	return path.Join(s.basePath, shard, tombstoneFileName)
+}
+
+func (s *tombstoneStore) loadShard(shard string) error {
+	f, err := os.Open(s.shardFileName(shard))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, tombstoneRecordOnDisk)
+	for {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// A short trailing record means a crash interrupted the
+				// previous append; drop it, the same way WAL replay
+				// tolerates a truncated tail record.
+				return nil
+			}
+			return err
+		}
+		if crc32.ChecksumIEEE(buf[:tombstoneRecordLen]) != binary.LittleEndian.Uint32(buf[tombstoneRecordLen:]) {
+			return nil
+		}
+		fp := clientmodel.Fingerprint(binary.LittleEndian.Uint64(buf[0:]))
+		from := clientmodel.Timestamp(binary.LittleEndian.Uint64(buf[8:]))
+		to := clientmodel.Timestamp(binary.LittleEndian.Uint64(buf[16:]))
+		s.ranges[fp] = append(s.ranges[fp], timeRange{from: from, to: to})
+	}
+}
+
+// add appends a new tombstone for fp to its shard's log, fsyncs it, and
+// records it in memory. This method is goroutine-safe.
+func (s *tombstoneStore) add(fp clientmodel.Fingerprint, from, to clientmodel.Timestamp) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	shard := fp.String()[0:2]
+	if err := os.MkdirAll(path.Join(s.basePath, shard), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.shardFileName(shard), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, tombstoneRecordOnDisk)
+	binary.LittleEndian.PutUint64(buf[0:], uint64(fp))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(from))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(to))
+	binary.LittleEndian.PutUint32(buf[tombstoneRecordLen:], crc32.ChecksumIEEE(buf[:tombstoneRecordLen]))
+
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	s.ranges[fp] = append(s.ranges[fp], timeRange{from: from, to: to})
+	return nil
+}
+
+// isDeleted reports whether ts falls within any tombstone recorded for
+// fp. This method is goroutine-safe.
+func (s *tombstoneStore) isDeleted(fp clientmodel.Fingerprint, ts clientmodel.Timestamp) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	for _, r := range s.ranges[fp] {
+		if r.contains(ts) {
+			return true
+		}
+	}
+	return false
+}
+
+// chunkEntirelyTombstoned reports whether every sample a chunk spanning
+// [first, last] could hold is covered by one of ranges, the same test
+// compactTombstones uses to decide whether a chunk can be physically
+// dropped. loadChunkDescs uses this to leave such a chunk out of a query's
+// result immediately, rather than waiting for runTombstoneCompactor to
+// reclaim its space.
+func chunkEntirelyTombstoned(ranges []timeRange, first, last clientmodel.Timestamp) bool {
+	for _, r := range ranges {
+		if r.covers(first, last) {
+			return true
+		}
+	}
+	return false
+}
+
+// rangesFor returns a copy of the tombstones recorded for fp.
+func (s *tombstoneStore) rangesFor(fp clientmodel.Fingerprint) []timeRange {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	out := make([]timeRange, len(s.ranges[fp]))
+	copy(out, s.ranges[fp])
+	return out
+}
+
+// fingerprints returns every fingerprint with at least one tombstone, for
+// runTombstoneCompactor to scan.
+func (s *tombstoneStore) fingerprints() clientmodel.Fingerprints {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	out := make(clientmodel.Fingerprints, 0, len(s.ranges))
+	for fp := range s.ranges {
+		out = append(out, fp)
+	}
+	return out
+}
+
+// replace sets fp's surviving tombstones to ranges (the subset compaction
+// determined still overlaps a chunk left on disk) and rewrites fp's
+// shard log accordingly. Called after compactTombstones has rewritten the
+// series file itself.
+func (s *tombstoneStore) replace(fp clientmodel.Fingerprint, ranges []timeRange) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(ranges) == 0 {
+		delete(s.ranges, fp)
+	} else {
+		s.ranges[fp] = ranges
+	}
+	return s.rewriteShard(fp.String()[0:2])
+}
+
+// rewriteShard atomically rewrites shard's on-disk log from the
+// in-memory ranges of every fingerprint belonging to it. Called with mtx
+// already held.
+func (s *tombstoneStore) rewriteShard(shard string) error {
+	dir := path.Join(s.basePath, shard)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tempName := s.shardFileName(shard) + ".tmp"
+	temp, err := os.OpenFile(tempName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, tombstoneRecordOnDisk)
+	for fp, ranges := range s.ranges {
+		if fp.String()[0:2] != shard {
+			continue
+		}
+		for _, r := range ranges {
+			binary.LittleEndian.PutUint64(buf[0:], uint64(fp))
+			binary.LittleEndian.PutUint64(buf[8:], uint64(r.from))
+			binary.LittleEndian.PutUint64(buf[16:], uint64(r.to))
+			binary.LittleEndian.PutUint32(buf[tombstoneRecordLen:], crc32.ChecksumIEEE(buf[:tombstoneRecordLen]))
+			if _, err := temp.Write(buf); err != nil {
+				temp.Close()
+				return err
+			}
+		}
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempName, s.shardFileName(shard))
+}
+
+// DeleteSeries tombstones every sample between from and to (inclusive)
+// for every series matching matchers. The deletion is durable and visible
+// to isDeleted, and to loadChunkDescs (which stops returning any chunk the
+// tombstone covers entirely), as soon as this call returns; the space it
+// frees is reclaimed later by runTombstoneCompactor, once a series'
+// tombstone density crosses tombstoneCompactionThreshold, rather than
+// rewriting the series file synchronously the way dropChunks does for
+// expiry. It returns the number of series tombstoned.
+//
+// This method is goroutine-safe.
+func (p *persistence) DeleteSeries(matchers []*matcher, from, to clientmodel.Timestamp) (int, error) {
+	fps, err := p.queryFingerprints(matchers)
+	if err != nil {
+		return 0, err
+	}
+	for _, fp := range fps {
+		if err := p.tombstones.add(fp, from, to); err != nil {
+			return 0, err
+		}
+		p.tombstonesCreated.Inc()
+	}
+	return len(fps), nil
+}
+
+// tombstoneDensity returns the fraction of fp's on-disk chunks that are
+// entirely covered by a tombstone.
+func (p *persistence) tombstoneDensity(fp clientmodel.Fingerprint) (float64, error) {
+	ranges := p.tombstones.rangesFor(fp)
+	if len(ranges) == 0 {
+		return 0, nil
+	}
+
+	f, err := p.openChunkFileForReading(fp)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	entries, err := walkChunkFile(f, p.chunkLen)
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	timesBuf := make([]byte, 16)
+	var covered int
+	for _, e := range entries {
+		if _, err := f.Seek(e.offset+chunkHeaderFirstTimeOffset, os.SEEK_SET); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(f, timesBuf); err != nil {
+			return 0, err
+		}
+		first := clientmodel.Timestamp(binary.LittleEndian.Uint64(timesBuf))
+		last := clientmodel.Timestamp(binary.LittleEndian.Uint64(timesBuf[8:]))
+		for _, r := range ranges {
+			if r.covers(first, last) {
+				covered++
+				break
+			}
+		}
+	}
+	return float64(covered) / float64(len(entries)), nil
+}
+
+// compactTombstones rewrites fp's series file to physically drop every
+// chunk entirely covered by one of its tombstones, then rewrites fp's
+// tombstone log to keep only the ranges that still overlap a surviving
+// chunk: a tombstone covering only chunks that just got dropped has
+// nothing left to apply to, but one that merely clips a surviving
+// chunk's edge is still needed by readers calling isDeleted.
+//
+// It serializes against Snapshot via snapshotMtx the same way dropChunks
+// does; like dropChunks, it is the caller's responsibility to make sure
+// nothing else is persisted or loaded for fp concurrently.
+func (p *persistence) compactTombstones(fp clientmodel.Fingerprint) error {
+	p.snapshotMtx.RLock()
+	defer p.snapshotMtx.RUnlock()
+
+	ranges := p.tombstones.rangesFor(fp)
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	f, err := p.openChunkFileForReading(fp)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries, err := walkChunkFile(f, p.chunkLen)
+	if err != nil {
+		return err
+	}
+
+	timesBuf := make([]byte, 16)
+	keep := make([]bool, len(entries))
+	stillNeeded := make([]bool, len(ranges))
+	var anyDropped bool
+	for i, e := range entries {
+		if _, err := f.Seek(e.offset+chunkHeaderFirstTimeOffset, os.SEEK_SET); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(f, timesBuf); err != nil {
+			return err
+		}
+		first := clientmodel.Timestamp(binary.LittleEndian.Uint64(timesBuf))
+		last := clientmodel.Timestamp(binary.LittleEndian.Uint64(timesBuf[8:]))
+
+		dropped := false
+		for _, r := range ranges {
+			if r.covers(first, last) {
+				dropped = true
+				break
+			}
+		}
+		keep[i] = !dropped
+		if dropped {
+			anyDropped = true
+			continue
+		}
+		for ri, r := range ranges {
+			if r.overlaps(first, last) {
+				stillNeeded[ri] = true
+			}
+		}
+	}
+	if !anyDropped {
+		return nil
+	}
+
+	temp, err := os.OpenFile(p.tempFileNameForFingerprint(fp), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if !keep[i] {
+			continue
+		}
+		if _, err := f.Seek(e.offset, os.SEEK_SET); err != nil {
+			temp.Close()
+			return err
+		}
+		if _, err := io.CopyN(temp, f, e.length); err != nil {
+			temp.Close()
+			return err
+		}
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(p.tempFileNameForFingerprint(fp), p.fileNameForFingerprint(fp)); err != nil {
+		return err
+	}
+
+	survivors := make([]timeRange, 0, len(ranges))
+	for ri, needed := range stillNeeded {
+		if needed {
+			survivors = append(survivors, ranges[ri])
+		}
+	}
+	p.compactedSeries.Inc()
+	return p.tombstones.replace(fp, survivors)
+}
+
+// runTombstoneCompactor periodically compacts every fingerprint whose
+// tombstone density crosses tombstoneCompactionThreshold, until
+// cleanupCtx is cancelled by close().
+func (p *persistence) runTombstoneCompactor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.cleanupCtx.Done():
+			return
+		case <-ticker.C:
+			for _, fp := range p.tombstones.fingerprints() {
+				density, err := p.tombstoneDensity(fp)
+				if err != nil {
+					glog.Warningf("Could not compute tombstone density for fingerprint %v: %s", fp, err)
+					continue
+				}
+				if density < *tombstoneCompactionThreshold {
+					continue
+				}
+				if err := p.compactTombstones(fp); err != nil {
+					glog.Warningf("Could not compact tombstones for fingerprint %v: %s", fp, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,411 @@
+// Copyright 2014 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+const (
+	walDirName = "wal"
+	// walSegmentSizeThreshold caps how large a single WAL segment file is
+	// allowed to grow before a new one is rolled, bounding the amount of
+	// data that has to be replayed from any one segment after a crash.
+	walSegmentSizeThreshold = 64 * 1024 * 1024 // 64MiB.
+
+	// walRecordLen is the fixed on-disk size of a walRecord, not counting
+	// its trailing CRC32: 8 bytes fingerprint + 8 bytes timestamp + 8
+	// bytes of the sample value's raw IEEE-754 bits + 1 byte op type.
+	walRecordLen = 25
+)
+
+// walOpType distinguishes what a walRecord is recording, so that replay can
+// tell an ordinary appended sample from a head-chunk state transition that
+// needs to be reflected differently.
+type walOpType byte
+
+const (
+	// walOpSample records a sample appended to a series' head chunk.
+	walOpSample walOpType = iota
+	// walOpHeadChunkPersisted records that a series' head chunk was
+	// written out to its chunk file and is no longer open for
+	// appending; replay must start a fresh head chunk for that
+	// fingerprint before applying any walOpSample that follows.
+	walOpHeadChunkPersisted
+)
+
+// walFsyncPolicy controls how aggressively the WAL calls fsync after a
+// write. "always" gives the strongest durability guarantee (every
+// LogSample/LogHeadChunkPersisted call is durable once it returns) at the
+// cost of one fsync per call; "interval" amortizes that cost across a
+// timer at the risk of losing up to the interval's worth of writes;
+// "never" never explicitly fsyncs, relying entirely on the OS (and is
+// intended for benchmarking, not production use).
+type walFsyncPolicy int
+
+const (
+	walFsyncAlways walFsyncPolicy = iota
+	walFsyncInterval
+	walFsyncNever
+)
+
+var (
+	walFsyncPolicyFlag = flag.String(
+		"storage.local.wal-fsync-policy",
+		"always",
+		"When to fsync WAL writes to disk. One of: always, interval, never.",
+	)
+	walFsyncIntervalFlag = flag.Duration(
+		"storage.local.wal-fsync-interval",
+		time.Second,
+		"How often to fsync the WAL when -storage.local.wal-fsync-policy is 'interval'.",
+	)
+)
+
+func configuredWALFsyncPolicy() walFsyncPolicy {
+	switch *walFsyncPolicyFlag {
+	case "interval":
+		return walFsyncInterval
+	case "never":
+		return walFsyncNever
+	default:
+		return walFsyncAlways
+	}
+}
+
+// walRecord is a single logged event, the unit of durability the WAL
+// guarantees between checkpoints. checkpointSeriesMapAndHeads only durably
+// captures head-chunk state at checkpoint time; everything that happens to
+// a head chunk after that point would be lost on an ungraceful shutdown
+// without the WAL recording it first.
+type walRecord struct {
+	fingerprint clientmodel.Fingerprint
+	timestamp   clientmodel.Timestamp
+	value       metric.SampleValue
+	op          walOpType
+}
+
+// wal is a segmented, CRC-protected write-ahead log of appended samples and
+// head-chunk state transitions. A record is considered durable once
+// LogSample/LogHeadChunkPersisted returns without error under
+// walFsyncAlways; under the other fsync policies, durability is bounded by
+// walFsyncIntervalFlag or left entirely to the OS.
+type wal struct {
+	dir          string
+	fsyncPolicy  walFsyncPolicy
+	fsyncStop    chan struct{}
+	fsyncStopped chan struct{}
+
+	mtx         sync.Mutex
+	segmentFile *os.File
+	segmentBuf  *bufio.Writer
+	segmentSize int64
+	nextSegment int
+}
+
+// newWAL opens (creating if necessary) the WAL directory under basePath and
+// starts a fresh segment for new writes. It does not replay existing
+// segments; replayWAL does that, and loadSeriesMapAndHeads calls it after
+// newPersistence has opened the WAL.
+func newWAL(basePath string) (*wal, error) {
+	dir := path.Join(basePath, walDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	w := &wal{
+		dir:         dir,
+		fsyncPolicy: configuredWALFsyncPolicy(),
+	}
+	existing, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		w.nextSegment = existing[len(existing)-1] + 1
+	}
+	if err := w.rollSegment(); err != nil {
+		return nil, err
+	}
+	if w.fsyncPolicy == walFsyncInterval {
+		w.fsyncStop = make(chan struct{})
+		w.fsyncStopped = make(chan struct{})
+		go w.runFsyncTicker()
+	}
+	return w, nil
+}
+
+// runFsyncTicker periodically fsyncs the active segment while fsyncPolicy
+// is walFsyncInterval, amortizing the fsync cost of individual writes
+// across -storage.local.wal-fsync-interval.
+func (w *wal) runFsyncTicker() {
+	defer close(w.fsyncStopped)
+	ticker := time.NewTicker(*walFsyncIntervalFlag)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.mtx.Lock()
+			if err := w.flushAndSync(); err != nil {
+				glog.Error("Error fsyncing WAL on interval: ", err)
+			}
+			w.mtx.Unlock()
+		case <-w.fsyncStop:
+			return
+		}
+	}
+}
+
+func (w *wal) segmentPath(n int) string {
+	return path.Join(w.dir, fmt.Sprintf("%08d.seg", n))
+}
+
+// segments returns the sorted segment numbers currently on disk.
+func (w *wal) segments() ([]int, error) {
+	entries, err := ioutilReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	var nums []int
+	for _, name := range entries {
+		if !strings.HasSuffix(name, ".seg") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(name, ".seg"))
+		if err != nil {
+			continue
+		}
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+	return nums, nil
+}
+
+func (w *wal) rollSegment() error {
+	if w.segmentFile != nil {
+		if err := w.flushAndSync(); err != nil {
+			return err
+		}
+		if err := w.segmentFile.Close(); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(w.segmentPath(w.nextSegment), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	w.segmentFile = f
+	w.segmentBuf = bufio.NewWriterSize(f, fileBufSize)
+	w.segmentSize = 0
+	w.nextSegment++
+	return nil
+}
+
+// LogSample appends a record for (fp, ts, v) to the active segment. Under
+// walFsyncAlways (the default), it fsyncs before returning so that a
+// successful call guarantees durability across a crash.
+func (w *wal) LogSample(fp clientmodel.Fingerprint, ts clientmodel.Timestamp, v metric.SampleValue) error {
+	return w.logRecord(walRecord{fingerprint: fp, timestamp: ts, value: v, op: walOpSample})
+}
+
+// LogHeadChunkPersisted appends a record noting that fp's head chunk was
+// just written out to its chunk file, so that replay knows to start a
+// fresh head chunk for fp before applying any walOpSample that follows.
+func (w *wal) LogHeadChunkPersisted(fp clientmodel.Fingerprint) error {
+	return w.logRecord(walRecord{fingerprint: fp, op: walOpHeadChunkPersisted})
+}
+
+// logRecord appends rec to the active segment, applying fsyncPolicy before
+// returning. Segments are rolled once walSegmentSizeThreshold is exceeded.
+func (w *wal) logRecord(rec walRecord) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	buf := make([]byte, walRecordLen)
+	binary.LittleEndian.PutUint64(buf[0:], uint64(rec.fingerprint))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(rec.timestamp))
+	binary.LittleEndian.PutUint64(buf[16:], math.Float64bits(float64(rec.value)))
+	buf[24] = byte(rec.op)
+	crc := crc32.ChecksumIEEE(buf)
+
+	n, err := w.segmentBuf.Write(buf)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w.segmentBuf, binary.LittleEndian, crc); err != nil {
+		return err
+	}
+	w.segmentSize += int64(n) + 4
+
+	switch w.fsyncPolicy {
+	case walFsyncAlways:
+		if err := w.flushAndSync(); err != nil {
+			return err
+		}
+	default:
+		// walFsyncInterval relies on runFsyncTicker; walFsyncNever
+		// relies entirely on the OS. Both still need the bufio writer
+		// flushed so the bytes are at least visible to the OS.
+		if err := w.segmentBuf.Flush(); err != nil {
+			return err
+		}
+	}
+	if w.segmentSize >= walSegmentSizeThreshold {
+		return w.rollSegment()
+	}
+	return nil
+}
+
+func (w *wal) flushAndSync() error {
+	if err := w.segmentBuf.Flush(); err != nil {
+		return err
+	}
+	return w.segmentFile.Sync()
+}
+
+// Truncate discards all segments up to and including segment n, called
+// once checkpointSeriesMapAndHeads has durably captured everything they
+// contain.
+func (w *wal) Truncate(upToAndIncluding int) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, n := range segments {
+		if n > upToAndIncluding {
+			continue
+		}
+		if err := os.Remove(w.segmentPath(n)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes and closes the active segment.
+func (w *wal) Close() error {
+	if w.fsyncStop != nil {
+		close(w.fsyncStop)
+		<-w.fsyncStopped
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if err := w.flushAndSync(); err != nil {
+		return err
+	}
+	return w.segmentFile.Close()
+}
+
+// replayWAL reads every WAL segment under basePath in order and invokes fn
+// for each valid record found. A torn write (a record whose CRC does not
+// verify, typically the last record of the most recent segment) stops
+// replay of that segment but is not treated as an error, since it
+// represents exactly the in-flight write the WAL is meant to tolerate
+// losing.
+func replayWAL(basePath string, fn func(fp clientmodel.Fingerprint, ts clientmodel.Timestamp, v metric.SampleValue, op walOpType)) error {
+	dir := path.Join(basePath, walDirName)
+	w := &wal{dir: dir}
+	segments, err := w.segments()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, n := range segments {
+		if err := replaySegment(w.segmentPath(n), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replaySegment(path string, fn func(fp clientmodel.Fingerprint, ts clientmodel.Timestamp, v metric.SampleValue, op walOpType)) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, fileBufSize)
+	buf := make([]byte, walRecordLen)
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+		var crc uint32
+		if err := binary.Read(r, binary.LittleEndian, &crc); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				glog.Warningf("Torn write detected at end of WAL segment %s, stopping replay.", path)
+				return nil
+			}
+			return err
+		}
+		if crc != crc32.ChecksumIEEE(buf) {
+			glog.Warningf("CRC mismatch in WAL segment %s, stopping replay (torn write).", path)
+			return nil
+		}
+		fp := clientmodel.Fingerprint(binary.LittleEndian.Uint64(buf[0:]))
+		ts := clientmodel.Timestamp(binary.LittleEndian.Uint64(buf[8:]))
+		v := metric.SampleValue(math.Float64frombits(binary.LittleEndian.Uint64(buf[16:])))
+		op := walOpType(buf[24])
+		fn(fp, ts, v, op)
+	}
+}
+
+// ioutilReadDir returns the base names of the entries in dir, or an empty
+// slice (not an error) if dir does not exist yet.
+func ioutilReadDir(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}